@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Assurance failure actions.
+const (
+	AssuranceDeny      = "deny"
+	AssuranceDowngrade = "downgrade"
+)
+
+// AssuranceRequirement is the authentication assurance a scope demands. It is
+// met when the token's amr contains any of AMR, or its acr ranks at or above
+// MinACR in the policy's acr_levels. A token that does not meet it is denied,
+// or with OnFail "downgrade" holds DowngradeTo instead of the scope.
+type AssuranceRequirement struct {
+	AMR         []string `json:"amr,omitempty"`
+	MinACR      string   `json:"min_acr,omitempty"`
+	OnFail      string   `json:"on_fail,omitempty"`
+	DowngradeTo string   `json:"downgrade_to,omitempty"`
+}
+
+// AssuranceObservation is the assurance a token presented, and the scopes
+// downgraded because it fell short, as recorded in audit events.
+type AssuranceObservation struct {
+	ACR        string   `json:"acr,omitempty"`
+	AMR        []string `json:"amr,omitempty"`
+	Downgraded []string `json:"downgraded,omitempty"` // "scope->fallback"
+}
+
+// satisfiedBy reports whether claims meet the requirement.
+func (a *AssuranceRequirement) satisfiedBy(claims *OIDCClaims, levels []string) bool {
+	for _, m := range a.AMR {
+		if slices.Contains(claims.AMR, m) {
+			return true
+		}
+	}
+	if a.MinACR != "" {
+		if level := slices.Index(levels, claims.ACR); level >= 0 && level >= slices.Index(levels, a.MinACR) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AssuranceRequirement) String() string {
+	var parts []string
+	if len(a.AMR) > 0 {
+		parts = append(parts, "amr in ["+strings.Join(a.AMR, ", ")+"]")
+	}
+	if a.MinACR != "" {
+		parts = append(parts, "acr >= "+a.MinACR)
+	}
+	return strings.Join(parts, " or ")
+}
+
+// validateAssurance checks the assurance requirement of scope against the
+// policy's scopes and acr levels.
+func (p *Policy) validateAssurance(scope string, a *AssuranceRequirement) error {
+	if len(a.AMR) == 0 && a.MinACR == "" {
+		return fmt.Errorf("scopes: %s assurance requires amr or min_acr", scope)
+	}
+	if a.MinACR != "" && !slices.Contains(p.ACRLevels, a.MinACR) {
+		return fmt.Errorf("scopes: %s min_acr %q is not in acr_levels", scope, a.MinACR)
+	}
+	switch a.OnFail {
+	case "", AssuranceDeny:
+		if a.DowngradeTo != "" {
+			return fmt.Errorf("scopes: %s downgrade_to requires on_fail %q", scope, AssuranceDowngrade)
+		}
+	case AssuranceDowngrade:
+		fallback, ok := p.Scopes[a.DowngradeTo]
+		if !ok {
+			return fmt.Errorf("scopes: %s downgrades to undefined scope %q", scope, a.DowngradeTo)
+		}
+		if fallback.Assurance != nil {
+			return fmt.Errorf("scopes: %s downgrades to %s, which has its own assurance requirement", scope, a.DowngradeTo)
+		}
+	default:
+		return fmt.Errorf("scopes: %s on_fail must be %q or %q", scope, AssuranceDeny, AssuranceDowngrade)
+	}
+	return nil
+}
+
+// applyAssurance replaces the token's scopes whose assurance requirement is
+// not met by their fallback. It returns an error naming the first scope that
+// denies the token instead.
+func (p *Policy) applyAssurance(claims *OIDCClaims) ([]string, *AssuranceObservation, error) {
+	var observed *AssuranceObservation
+	if claims.ACR != "" || len(claims.AMR) > 0 {
+		observed = &AssuranceObservation{ACR: claims.ACR, AMR: claims.AMR}
+	}
+	scopes := make([]string, 0, len(claims.Scopes))
+	for _, scope := range claims.Scopes {
+		m, ok := p.Scopes[scope]
+		if !ok || m.Assurance == nil || m.Assurance.satisfiedBy(claims, p.ACRLevels) {
+			scopes = append(scopes, scope)
+			continue
+		}
+		a := m.Assurance
+		if a.OnFail != AssuranceDowngrade {
+			return nil, observed, fmt.Errorf("scope %s requires %s; token has acr %q, amr %v", scope, a, claims.ACR, claims.AMR)
+		}
+		if observed == nil {
+			observed = &AssuranceObservation{}
+		}
+		observed.Downgraded = append(observed.Downgraded, scope+"->"+a.DowngradeTo)
+		scopes = append(scopes, a.DowngradeTo)
+	}
+	return scopes, observed, nil
+}
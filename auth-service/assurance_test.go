@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func assurancePolicy(t *testing.T) *Policy {
+	t.Helper()
+	policy, err := ParsePolicy([]byte(`{
+		"acr_levels": ["bronze", "silver", "gold"],
+		"scopes": {
+			"prod:deploy": {
+				"pub_allow": ["prod.deploy.>"],
+				"assurance": {"amr": ["mfa", "hwk"], "min_acr": "silver"}
+			},
+			"prod:operator": {
+				"pub_allow": ["prod.>"], "sub_allow": ["prod.>"],
+				"assurance": {"amr": ["mfa"], "on_fail": "downgrade", "downgrade_to": "prod:viewer"}
+			},
+			"prod:viewer": {"sub_allow": ["prod.>"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	return policy
+}
+
+func TestEvaluate_AssuranceDeny(t *testing.T) {
+	policy := assurancePolicy(t)
+	for _, claims := range []*OIDCClaims{
+		{Subject: "alice", Scopes: []string{"prod:deploy"}, AMR: []string{"pwd", "mfa"}},
+		{Subject: "alice", Scopes: []string{"prod:deploy"}, ACR: "gold"},
+	} {
+		if d := policy.Evaluate(claims, nil, nil); !d.Allowed {
+			t.Errorf("expected acr %q amr %v to be allowed: %s", claims.ACR, claims.AMR, d.Reason)
+		}
+	}
+
+	claims := &OIDCClaims{Subject: "alice", Scopes: []string{"prod:deploy", "prod:viewer"}, ACR: "bronze", AMR: []string{"pwd"}}
+	d := policy.Evaluate(claims, nil, nil)
+	if d.Allowed || d.ReasonCode != "assurance_required" || !strings.Contains(d.Reason, "prod:deploy") {
+		t.Fatalf("expected denial for insufficient assurance, got %+v", d)
+	}
+	if d.Assurance == nil || d.Assurance.ACR != "bronze" || !reflect.DeepEqual(d.Assurance.AMR, []string{"pwd"}) {
+		t.Errorf("expected observed assurance to be recorded, got %+v", d.Assurance)
+	}
+
+	// An acr outside acr_levels ranks below every level.
+	if d := policy.Evaluate(&OIDCClaims{Subject: "alice", Scopes: []string{"prod:deploy"}, ACR: "platinum"}, nil, nil); d.Allowed {
+		t.Error("expected unknown acr to be denied")
+	}
+}
+
+func TestEvaluate_AssuranceDowngrade(t *testing.T) {
+	policy := assurancePolicy(t)
+
+	d := policy.Evaluate(&OIDCClaims{Subject: "bob", Scopes: []string{"prod:operator"}, AMR: []string{"pwd"}}, nil, nil)
+	if !d.Allowed {
+		t.Fatalf("expected downgraded token to be allowed: %s", d.Reason)
+	}
+	if expected := policy.ResolvePermissions([]string{"prod:viewer"}); !reflect.DeepEqual(d.Permissions, expected) {
+		t.Errorf("expected viewer permissions %+v, got %+v", expected, d.Permissions)
+	}
+	if d.Assurance == nil || !reflect.DeepEqual(d.Assurance.Downgraded, []string{"prod:operator->prod:viewer"}) {
+		t.Errorf("expected downgrade to be recorded, got %+v", d.Assurance)
+	}
+
+	d = policy.Evaluate(&OIDCClaims{Subject: "bob", Scopes: []string{"prod:operator"}, AMR: []string{"mfa"}}, nil, nil)
+	if !reflect.DeepEqual(d.Permissions.PubAllow, []string{"prod.>"}) || len(d.Assurance.Downgraded) != 0 {
+		t.Errorf("expected full operator permissions with MFA, got %+v", d.Permissions)
+	}
+
+	// Tokens without acr/amr claims record no observation unless downgraded.
+	if d := policy.Evaluate(&OIDCClaims{Subject: "bob", Scopes: []string{"prod:viewer"}}, nil, nil); d.Assurance != nil {
+		t.Errorf("expected no assurance observation, got %+v", d.Assurance)
+	}
+}
+
+func TestParsePolicy_InvalidAssurance(t *testing.T) {
+	for _, doc := range []string{
+		`{"scopes": {"a": {"assurance": {}}}}`,
+		`{"scopes": {"a": {"assurance": {"min_acr": "gold"}}}}`,
+		`{"scopes": {"a": {"assurance": {"amr": ["mfa"], "on_fail": "ignore"}}}}`,
+		`{"scopes": {"a": {"assurance": {"amr": ["mfa"], "downgrade_to": "b"}}, "b": {}}}`,
+		`{"scopes": {"a": {"assurance": {"amr": ["mfa"], "on_fail": "downgrade", "downgrade_to": "missing"}}}}`,
+		`{"scopes": {"a": {"assurance": {"amr": ["mfa"], "on_fail": "downgrade", "downgrade_to": "b"}},
+		             "b": {"assurance": {"amr": ["pwd"]}}}}`,
+	} {
+		if _, err := ParsePolicy([]byte(doc)); err == nil {
+			t.Errorf("expected error for %s", doc)
+		}
+	}
+}
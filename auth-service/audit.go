@@ -18,13 +18,94 @@ type AuditEvent struct {
 	Scopes      []string      `json:"scopes,omitempty"`
 	Decision    string        `json:"decision"`
 	Reason      string        `json:"reason,omitempty"`
+	ReasonCode  string        `json:"reason_code,omitempty"`
 	Permissions *GrantedPerms `json:"permissions,omitempty"`
+
+	OverrideApplied bool              `json:"override_applied"`
+	Requested       *DownscopeRequest `json:"requested,omitempty"`
+	Grants          []string          `json:"grants,omitempty"`
+	Revocation      *Revocation       `json:"revocation,omitempty"`
+
+	// Assurance is the acr/amr the token presented and any scopes
+	// downgraded for falling short of their assurance requirement.
+	Assurance *AssuranceObservation `json:"assurance,omitempty"`
 }
 
 // GrantedPerms represents the NATS permissions granted to a user.
 type GrantedPerms struct {
 	PubAllow []string `json:"pub_allow,omitempty"`
 	SubAllow []string `json:"sub_allow,omitempty"`
+	PubDeny  []string `json:"pub_deny,omitempty"`
+	SubDeny  []string `json:"sub_deny,omitempty"`
+}
+
+// ShadowDiffEvent records a callout where the candidate policy would have
+// decided differently from the active policy.
+type ShadowDiffEvent struct {
+	Timestamp   time.Time        `json:"timestamp"`
+	UserNKey    string           `json:"user_nkey"`
+	ClientIP    string           `json:"client_ip"`
+	TokenIssuer string           `json:"token_issuer,omitempty"`
+	TokenSub    string           `json:"token_sub,omitempty"`
+	Scopes      []string         `json:"scopes,omitempty"`
+	Decision    string           `json:"decision"`
+	Reason      string           `json:"reason,omitempty"`
+	Differences []string         `json:"differences"`
+	Active      *DecisionSummary `json:"active"`
+	Candidate   *DecisionSummary `json:"candidate"`
+}
+
+// GrantEvent records the lifecycle of an elevation grant: "created",
+// "used", "revoked" or "expired".
+type GrantEvent struct {
+	Timestamp   time.Time `json:"timestamp"`
+	UserNKey    string    `json:"user_nkey,omitempty"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	TokenIssuer string    `json:"token_issuer"`
+	TokenSub    string    `json:"token_sub"`
+	Decision    string    `json:"decision"`
+	Reason      string    `json:"reason,omitempty"`
+	Grant       *Grant    `json:"grant"`
+}
+
+// RevocationEvent records a change to the revocation list: "added" or
+// "removed".
+type RevocationEvent struct {
+	Timestamp   time.Time   `json:"timestamp"`
+	TokenIssuer string      `json:"token_issuer"`
+	Decision    string      `json:"decision"`
+	Reason      string      `json:"reason,omitempty"`
+	Revocation  *Revocation `json:"revocation"`
+}
+
+// DecisionSummary is the audit representation of a policy Decision.
+type DecisionSummary struct {
+	Allowed     bool          `json:"allowed"`
+	Reason      string        `json:"reason,omitempty"`
+	Account     string        `json:"account"`
+	Permissions *GrantedPerms `json:"permissions,omitempty"`
+	Limits      *UserLimits   `json:"limits,omitempty"`
+}
+
+// NewGrantedPerms converts resolved permissions into their audit representation.
+func NewGrantedPerms(perms *ResolvedPermissions) *GrantedPerms {
+	return &GrantedPerms{
+		PubAllow: perms.PubAllow,
+		SubAllow: perms.SubAllow,
+		PubDeny:  perms.PubDeny,
+		SubDeny:  perms.SubDeny,
+	}
+}
+
+// NewDecisionSummary converts a policy Decision into its audit representation.
+func NewDecisionSummary(d *Decision) *DecisionSummary {
+	return &DecisionSummary{
+		Allowed:     d.Allowed,
+		Reason:      d.Reason,
+		Account:     d.Account,
+		Permissions: NewGrantedPerms(d.Permissions),
+		Limits:      d.Limits,
+	}
 }
 
 // AuditPublisher publishes auth decision events to NATS.
@@ -51,7 +132,41 @@ func (a *AuditPublisher) PublishFailure(event AuditEvent) {
 	a.publish("auth.audit.failure", event)
 }
 
-func (a *AuditPublisher) publish(subject string, event AuditEvent) {
+// PublishShadowDiff publishes a shadow policy evaluation that diverged from the active policy.
+func (a *AuditPublisher) PublishShadowDiff(event ShadowDiffEvent) {
+	event.Decision = "shadow_diff"
+	event.Timestamp = time.Now().UTC()
+	a.publish("auth.audit.shadow", event)
+}
+
+// PublishGrant publishes a grant lifecycle event to auth.audit.grant.<action>.
+func (a *AuditPublisher) PublishGrant(action string, g *Grant) {
+	a.PublishGrantEvent(action, GrantEvent{Grant: g})
+}
+
+// PublishGrantEvent publishes a grant lifecycle event with connection details.
+func (a *AuditPublisher) PublishGrantEvent(action string, event GrantEvent) {
+	event.Decision = "grant_" + action
+	event.Timestamp = time.Now().UTC()
+	event.TokenIssuer = event.Grant.Issuer
+	event.TokenSub = event.Grant.Subject
+	event.Reason = event.Grant.Reason
+	a.publish("auth.audit.grant."+action, event)
+}
+
+// PublishRevocation publishes a revocation list change to
+// auth.audit.revocation.<action>.
+func (a *AuditPublisher) PublishRevocation(action string, r *Revocation) {
+	a.publish("auth.audit.revocation."+action, RevocationEvent{
+		Timestamp:   time.Now().UTC(),
+		TokenIssuer: r.Issuer,
+		Decision:    "revocation_" + action,
+		Reason:      r.Reason,
+		Revocation:  r,
+	})
+}
+
+func (a *AuditPublisher) publish(subject string, event any) {
 	data, err := json.Marshal(event)
 	if err != nil {
 		log.Printf("Failed to marshal audit event: %v", err)
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/nats-io/jwt/v2"
@@ -13,8 +15,32 @@ import (
 // AuthorizerFunc validates an auth request and returns a signed UserClaims JWT.
 type AuthorizerFunc func(req *jwt.AuthorizationRequestClaims) (string, error)
 
+// responsePermission lets every user answer requests it receives.
+var responsePermission = jwt.ResponsePermission{
+	MaxMsgs: 1,
+	Expires: 5 * time.Minute,
+}
+
+// AuthorizerConfig holds the dependencies of the authorizer.
+type AuthorizerConfig struct {
+	Verifiers    *VerifierSet
+	Policies     *PolicyStore
+	Overrides    *OverrideStore  // optional
+	Grants       *GrantStore     // optional
+	Revocations  *RevocationList // optional
+	SigningKey   nkeys.KeyPair
+	IssuerPubKey string
+	Audit        *AuditPublisher
+	Metrics      *Metrics
+}
+
 // NewAuthorizer returns an AuthorizerFunc that validates OIDC tokens and maps scopes to NATS permissions.
-func NewAuthorizer(verifiers []*OIDCVerifier, signingKey nkeys.KeyPair, issuerPubKey string, audit *AuditPublisher) AuthorizerFunc {
+// When the policy store holds a candidate policy, it is evaluated alongside the active policy and any
+// divergence is published as a shadow diff event; only the active decision is enforced.
+func NewAuthorizer(cfg AuthorizerConfig) AuthorizerFunc {
+	verifiers, policies, overrides, grants, revocations := cfg.Verifiers, cfg.Policies, cfg.Overrides, cfg.Grants, cfg.Revocations
+	signingKey, audit, metrics := cfg.SigningKey, cfg.Audit, cfg.Metrics
+
 	return func(req *jwt.AuthorizationRequestClaims) (string, error) {
 		rawToken := req.ConnectOptions.Token
 		if rawToken == "" {
@@ -32,51 +58,129 @@ func NewAuthorizer(verifiers []*OIDCVerifier, signingKey nkeys.KeyPair, issuerPu
 			return "", fmt.Errorf("no authentication token provided")
 		}
 
-		// Validate OIDC token against all configured issuers
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		claims, issuer, err := ValidateToken(ctx, rawToken, verifiers)
+		// A client may ask for a subset of its entitlement via the CONNECT username
+		downscope, err := ParseDownscopeRequest(req.ConnectOptions.Username)
 		if err != nil {
 			audit.PublishFailure(AuditEvent{
 				UserNKey: req.UserNkey,
 				ClientIP: clientIP,
-				Reason:   fmt.Sprintf("token validation failed: %v", err),
+				Reason:   fmt.Sprintf("invalid downscope request: %v", err),
 			})
+			return "", fmt.Errorf("invalid downscope request: %w", err)
+		}
+
+		// Validate the OIDC token with the verifier of its issuer
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		claims, issuer, err := ValidateToken(ctx, rawToken, verifiers)
+		if err != nil {
+			event := AuditEvent{
+				UserNKey:    req.UserNkey,
+				ClientIP:    clientIP,
+				TokenIssuer: issuer,
+				Reason:      fmt.Sprintf("token validation failed: %v", err),
+			}
+			var tokenErr *TokenError
+			if errors.As(err, &tokenErr) {
+				event.ReasonCode = tokenErr.Code()
+			}
+			audit.PublishFailure(event)
 			return "", fmt.Errorf("authentication failed: %w", err)
 		}
 
 		log.Printf("Token validated: sub=%s scopes=%v issuer=%s", claims.Subject, claims.Scopes, issuer)
 
-		// Map OIDC scopes to NATS permissions
-		perms := ResolvePermissions(claims.Scopes)
-		if !perms.HasPermissions() {
+		// Deny tokens on the revocation list even though they are still valid
+		if r := revocations.Check(issuer, claims); r != nil {
+			metrics.Inc("auth_revocation_hits_total", "kind", r.Kind)
 			audit.PublishFailure(AuditEvent{
 				UserNKey:    req.UserNkey,
 				ClientIP:    clientIP,
 				TokenIssuer: issuer,
 				TokenSub:    claims.Subject,
 				Scopes:      claims.Scopes,
-				Reason:      "no authorized NATS scopes in token",
+				Reason:      fmt.Sprintf("token revoked by %s %s: %s", r.Kind, r.Value, r.Reason),
+				ReasonCode:  "token_revoked",
+				Revocation:  r,
 			})
-			return "", fmt.Errorf("no authorized NATS scopes found for subject %s (scopes: %v)", claims.Subject, claims.Scopes)
+			return "", fmt.Errorf("token revoked for subject %s", claims.Subject)
+		}
+
+		// Map OIDC scopes to NATS permissions, apply any per-identity override and
+		// elevation grants, then narrow the result to what the client requested
+		now := time.Now()
+		override := overrides.Lookup(claims.Issuer, claims.Subject)
+		elevations := grants.Active(claims.Issuer, claims.Subject, now)
+		inbox := InboxPrefix(claims.Issuer, claims.Subject) + ".>"
+		evaluate := func(p *Policy) *Decision {
+			scoped := *claims
+			scoped.Scopes = downscope.FilterScopes(claims.Scopes)
+			d := p.Evaluate(&scoped, override, elevations)
+			downscope.Apply(d, inbox)
+			return d
+		}
+
+		decision := evaluate(policies.Active())
+		if candidate := policies.Candidate(); candidate != nil {
+			shadowEvaluate(req, claims, issuer, decision, evaluate(candidate), audit, metrics)
+		}
+
+		if decision.ReasonCode == "assurance_required" {
+			metrics.Inc("auth_assurance_failures_total", "action", AssuranceDeny)
+		} else if decision.Assurance != nil && len(decision.Assurance.Downgraded) > 0 {
+			metrics.Inc("auth_assurance_failures_total", "action", AssuranceDowngrade)
+		}
+
+		perms := decision.Permissions
+		if !decision.Allowed {
+			audit.PublishFailure(AuditEvent{
+				UserNKey:        req.UserNkey,
+				ClientIP:        clientIP,
+				TokenIssuer:     issuer,
+				TokenSub:        claims.Subject,
+				Scopes:          claims.Scopes,
+				Reason:          decision.Reason,
+				ReasonCode:      decision.ReasonCode,
+				OverrideApplied: decision.OverrideApplied,
+				Requested:       downscope,
+				Assurance:       decision.Assurance,
+			})
+			return "", fmt.Errorf("authorization denied for subject %s (scopes: %v): %s", claims.Subject, claims.Scopes, decision.Reason)
 		}
 
 		// Build UserClaims JWT
 		uc := jwt.NewUserClaims(req.UserNkey)
 		uc.Name = claims.Subject
-		uc.Audience = "APP"
-		uc.Expires = time.Now().Add(1 * time.Hour).Unix()
-		uc.IssuedAt = time.Now().Unix()
+		uc.Audience = decision.Account
+		expires := now.Add(1 * time.Hour)
+		if !decision.Expires.IsZero() && decision.Expires.Before(expires) {
+			// Elevated access ends with the earliest grant
+			expires = decision.Expires
+		}
+		uc.Expires = expires.Unix()
+		uc.IssuedAt = now.Unix()
 
 		uc.Pub.Allow.Add(perms.PubAllow...)
 		uc.Sub.Allow.Add(perms.SubAllow...)
+		uc.Pub.Deny.Add(perms.PubDeny...)
+		uc.Sub.Deny.Add(perms.SubDeny...)
+
+		if l := decision.Limits; l != nil {
+			if l.Subs != 0 {
+				uc.Limits.Subs = l.Subs
+			}
+			if l.Payload != 0 {
+				uc.Limits.Payload = l.Payload
+			}
+			if l.Data != 0 {
+				uc.Limits.Data = l.Data
+			}
+		}
 
 		// Allow request-reply
-		uc.Resp = &jwt.ResponsePermission{
-			MaxMsgs: 1,
-			Expires: 5 * time.Minute,
-		}
+		resp := responsePermission
+		uc.Resp = &resp
 
 		encoded, err := uc.Encode(signingKey)
 		if err != nil {
@@ -84,18 +188,50 @@ func NewAuthorizer(verifiers []*OIDCVerifier, signingKey nkeys.KeyPair, issuerPu
 		}
 
 		audit.PublishSuccess(AuditEvent{
-			UserNKey:    req.UserNkey,
-			ClientIP:    clientIP,
-			TokenIssuer: issuer,
-			TokenSub:    claims.Subject,
-			Scopes:      claims.Scopes,
-			Permissions: &GrantedPerms{
-				PubAllow: perms.PubAllow,
-				SubAllow: perms.SubAllow,
-			},
+			UserNKey:        req.UserNkey,
+			ClientIP:        clientIP,
+			TokenIssuer:     issuer,
+			TokenSub:        claims.Subject,
+			Scopes:          claims.Scopes,
+			Permissions:     NewGrantedPerms(perms),
+			OverrideApplied: decision.OverrideApplied,
+			Requested:       downscope,
+			Grants:          decision.Grants,
+			Assurance:       decision.Assurance,
 		})
+		for _, g := range elevations {
+			audit.PublishGrantEvent("used", GrantEvent{UserNKey: req.UserNkey, ClientIP: clientIP, Grant: g})
+		}
 
-		log.Printf("Authorized %s (sub=%s) pub=%v sub=%v", req.UserNkey, claims.Subject, perms.PubAllow, perms.SubAllow)
+		log.Printf("Authorized %s (sub=%s) pub=%v sub=%v deny_pub=%v deny_sub=%v",
+			req.UserNkey, claims.Subject, perms.PubAllow, perms.SubAllow, perms.PubDeny, perms.SubDeny)
 		return encoded, nil
 	}
 }
+
+// shadowEvaluate compares the candidate policy's decision with the active one
+// and publishes a diff event when they diverge.
+func shadowEvaluate(req *jwt.AuthorizationRequestClaims, claims *OIDCClaims, issuer string, active, candidate *Decision, audit *AuditPublisher, metrics *Metrics) {
+	metrics.Inc("auth_shadow_evaluations_total")
+
+	diffs := DiffDecisions(active, candidate)
+	if len(diffs) == 0 {
+		return
+	}
+	for _, field := range diffs {
+		metrics.Inc("auth_shadow_diffs_total", "field", field)
+	}
+
+	log.Printf("Shadow policy diverged for sub=%s: %v", claims.Subject, diffs)
+	audit.PublishShadowDiff(ShadowDiffEvent{
+		UserNKey:    req.UserNkey,
+		ClientIP:    req.ClientInformation.Host,
+		TokenIssuer: issuer,
+		TokenSub:    claims.Subject,
+		Scopes:      claims.Scopes,
+		Reason:      "candidate policy differs in: " + strings.Join(diffs, ", "),
+		Differences: diffs,
+		Active:      NewDecisionSummary(active),
+		Candidate:   NewDecisionSummary(candidate),
+	})
+}
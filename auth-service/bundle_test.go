@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+)
+
+const bundleTestPolicy = `{"scopes": {"nats:admin": {"pub_allow": [">"]}}}`
+
+var policyTarget = BundleTarget{Kind: BundlePolicy}
+
+func signedBundle(t *testing.T, kp nkeys.KeyPair, target BundleTarget, version uint64, policy string) []byte {
+	t.Helper()
+	bundle, err := SignPolicy([]byte(policy), target, version, kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestLoadPolicy_SignedBundle(t *testing.T) {
+	kp, _ := nkeys.CreateOperator()
+	pub, _ := kp.PublicKey()
+	trust, err := ParsePolicyTrust(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, signedBundle(t, kp, policyTarget, 3, bundleTestPolicy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicy(path, trust)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if policy.Meta.Signer != pub || policy.Meta.Version != 3 || !policy.Meta.SignatureVerified || policy.Meta.Digest == "" {
+		t.Errorf("unexpected policy metadata %+v", policy.Meta)
+	}
+	if _, ok := policy.Scopes["nats:admin"]; !ok {
+		t.Error("expected signed policy scopes to load")
+	}
+}
+
+func TestOpenPolicyDocument_Rejections(t *testing.T) {
+	trusted, _ := nkeys.CreateOperator()
+	trustedPub, _ := trusted.PublicKey()
+	other, _ := nkeys.CreateOperator()
+	trust, _ := ParsePolicyTrust(trustedPub)
+
+	if _, _, err := OpenPolicyDocument([]byte(bundleTestPolicy), "test", trust, policyTarget); err == nil {
+		t.Error("expected unsigned policy to be rejected when keys are trusted")
+	}
+	if _, _, err := OpenPolicyDocument(signedBundle(t, other, policyTarget, 1, bundleTestPolicy), "test", trust, policyTarget); err == nil {
+		t.Error("expected policy signed by an untrusted key to be rejected")
+	}
+
+	tamper := func(change func(*PolicyBundle)) []byte {
+		var b PolicyBundle
+		json.Unmarshal(signedBundle(t, trusted, policyTarget, 1, bundleTestPolicy), &b)
+		change(&b)
+		data, _ := json.Marshal(b)
+		return data
+	}
+	for name, data := range map[string][]byte{
+		"document": tamper(func(b *PolicyBundle) {
+			b.Policy = []byte(`{"scopes": {"nats:admin": {"pub_allow": [">"], "privileged": true}}}`)
+		}),
+		"version": tamper(func(b *PolicyBundle) { b.Version = 99 }),
+	} {
+		if _, _, err := OpenPolicyDocument(data, "test", trust, policyTarget); err == nil {
+			t.Errorf("expected bundle with tampered %s to be rejected", name)
+		}
+	}
+
+	// Without trusted keys, plain documents load and bundles are unwrapped
+	// unverified, without reporting a signer.
+	doc, meta, err := OpenPolicyDocument(signedBundle(t, other, policyTarget, 1, bundleTestPolicy), "test", nil, policyTarget)
+	if err != nil || string(doc) != bundleTestPolicy || meta.SignatureVerified || meta.Signer != "" || meta.Version != 0 {
+		t.Errorf("expected unverified unwrap, got %q %+v %v", doc, meta, err)
+	}
+}
+
+func TestOpenPolicyDocument_Target(t *testing.T) {
+	kp, _ := nkeys.CreateOperator()
+	pub, _ := kp.PublicKey()
+	trust, _ := ParsePolicyTrust(pub)
+	acme := BundleTarget{Kind: BundleFragment, Tenant: "acme"}
+
+	fragment := signedBundle(t, kp, acme, 1, bundleTestPolicy)
+	if _, _, err := OpenPolicyDocument(fragment, "test", trust, acme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, target := range map[string]BundleTarget{
+		"base policy":    policyTarget,
+		"another tenant": {Kind: BundleFragment, Tenant: "globex"},
+	} {
+		if _, _, err := OpenPolicyDocument(fragment, "test", trust, target); err == nil || !strings.Contains(err.Error(), "signed for") {
+			t.Errorf("%s: expected fragment bundle to be rejected, got %v", name, err)
+		}
+	}
+	if _, _, err := OpenPolicyDocument(signedBundle(t, kp, policyTarget, 1, bundleTestPolicy), "test", trust, acme); err == nil {
+		t.Error("expected policy bundle to be rejected as a fragment")
+	}
+
+	for name, target := range map[string]BundleTarget{
+		"unknown kind":         {Kind: "overrides"},
+		"policy with tenant":   {Kind: BundlePolicy, Tenant: "acme"},
+		"fragment sans tenant": {Kind: BundleFragment},
+	} {
+		if _, err := SignPolicy([]byte(bundleTestPolicy), target, 1, kp); err == nil {
+			t.Errorf("%s: expected signing to fail", name)
+		}
+	}
+	if _, err := SignPolicy([]byte(bundleTestPolicy), policyTarget, 0, kp); err == nil {
+		t.Error("expected version 0 to be refused")
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	current := PolicyMeta{Source: "test", Digest: "aa", Version: 5, SignatureVerified: true}
+	for _, next := range []PolicyMeta{
+		{Digest: "aa", Version: 5, SignatureVerified: true},
+		{Digest: "bb", Version: 6, SignatureVerified: true},
+		{Digest: "bb", Version: 1},
+	} {
+		if err := checkVersion(next, current); err != nil {
+			t.Errorf("expected %+v to be accepted, got %v", next, err)
+		}
+	}
+	for _, next := range []PolicyMeta{
+		{Digest: "bb", Version: 4, SignatureVerified: true},
+		{Digest: "bb", Version: 5, SignatureVerified: true},
+	} {
+		if err := checkVersion(next, current); err == nil {
+			t.Errorf("expected %+v to be rejected", next)
+		}
+	}
+	if err := checkVersion(PolicyMeta{Version: 1, SignatureVerified: true}, PolicyMeta{}); err != nil {
+		t.Errorf("expected the first policy to be accepted, got %v", err)
+	}
+}
+
+func TestPolicyTrust_Ed25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := "ed25519:" + base64.StdEncoding.EncodeToString(pub)
+	trust, err := ParsePolicyTrust("  " + signer + " ,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bundle := &PolicyBundle{Kind: BundlePolicy, Version: 1, Policy: []byte(bundleTestPolicy), Signer: signer}
+	bundle.Signature = ed25519.Sign(priv, bundle.SignedData())
+	if _, err := trust.Open(bundle); err != nil {
+		t.Errorf("expected ed25519 signature to verify, got %v", err)
+	}
+	bundle.Signature[0] ^= 0xff
+	if _, err := trust.Open(bundle); err == nil {
+		t.Error("expected corrupted ed25519 signature to fail")
+	}
+
+	if _, err := ParsePolicyTrust("ed25519:not-a-key"); err == nil {
+		t.Error("expected invalid ed25519 key to be rejected")
+	}
+	if _, err := ParsePolicyTrust(""); err == nil {
+		t.Error("expected empty trust list to be rejected")
+	}
+}
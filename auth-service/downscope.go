@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DownscopeRequest is the subset of its entitlement a client asks for at
+// connect time. It is carried in ConnectOptions.Username as ';'-separated
+// clauses, each a key and a ','-separated list:
+//
+//	roles=nats:publish;pub=orders.eu.>;sub=events.eu.>
+//
+// roles restricts which token scopes are resolved; pub and sub restrict the
+// granted allow lists in that direction. Directions without a clause keep
+// their full entitlement.
+type DownscopeRequest struct {
+	Roles []string `json:"roles,omitempty"`
+	Pub   []string `json:"pub,omitempty"`
+	Sub   []string `json:"sub,omitempty"`
+}
+
+// ParseDownscopeRequest parses a downscope request from a CONNECT username.
+// Usernames without '=' are not downscope requests and yield nil.
+func ParseDownscopeRequest(username string) (*DownscopeRequest, error) {
+	if !strings.Contains(username, "=") {
+		return nil, nil
+	}
+	req := &DownscopeRequest{}
+	for _, clause := range strings.Split(username, ";") {
+		if clause == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(clause, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed downscope clause %q", clause)
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		if len(items) == 0 {
+			return nil, fmt.Errorf("empty downscope clause %q", key)
+		}
+		switch strings.TrimSpace(key) {
+		case "roles":
+			req.Roles = append(req.Roles, items...)
+		case "pub":
+			req.Pub = append(req.Pub, items...)
+		case "sub":
+			req.Sub = append(req.Sub, items...)
+		default:
+			return nil, fmt.Errorf("unknown downscope clause %q", key)
+		}
+	}
+	return req, nil
+}
+
+// FilterScopes returns the token scopes that were requested as roles. All
+// scopes are kept when no roles were requested.
+func (r *DownscopeRequest) FilterScopes(scopes []string) []string {
+	if r == nil || len(r.Roles) == 0 {
+		return scopes
+	}
+	var out []string
+	for _, s := range scopes {
+		if slices.Contains(r.Roles, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Apply intersects the decision's allow lists with the requested subjects.
+// The identity's private inbox is always kept so request-reply keeps working.
+// Denies are never relaxed.
+func (r *DownscopeRequest) Apply(d *Decision, inbox string) {
+	if r == nil || !d.Allowed {
+		return
+	}
+	perms := d.Permissions
+	if r.Pub != nil {
+		perms.PubAllow = intersectSubjects(perms.PubAllow, r.Pub)
+	}
+	if r.Sub != nil {
+		keep := slices.Contains(perms.SubAllow, inbox)
+		perms.SubAllow = intersectSubjects(perms.SubAllow, r.Sub)
+		if keep && !slices.Contains(perms.SubAllow, inbox) {
+			perms.SubAllow = append(perms.SubAllow, inbox)
+		}
+	}
+	if !perms.HasPermissions() {
+		d.Allowed = false
+		d.Reason = "requested permissions are not granted by token"
+	}
+}
+
+// intersectSubjects returns the subject spaces present in both lists: for
+// every pair where one subject covers the other, the narrower one. Pairs that
+// merely overlap are dropped, so the result never exceeds granted.
+func intersectSubjects(granted, requested []string) []string {
+	var out []string
+	for _, r := range requested {
+		for _, g := range granted {
+			var s string
+			switch {
+			case subjectCovers(g, r):
+				s = r
+			case subjectCovers(r, g):
+				s = g
+			default:
+				continue
+			}
+			if !slices.Contains(out, s) {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// subjectCovers reports whether every subject matched by sub is also matched
+// by pattern. Both may contain wildcards.
+func subjectCovers(pattern, sub string) bool {
+	pt := strings.Split(pattern, ".")
+	st := strings.Split(sub, ".")
+	for i, p := range pt {
+		if p == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) {
+			return false
+		}
+		switch s := st[i]; {
+		case s == ">":
+			return false
+		case p == "*":
+		case p != s:
+			return false
+		}
+	}
+	return len(pt) == len(st)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseDownscopeRequest(t *testing.T) {
+	req, err := ParseDownscopeRequest("roles=nats:publish;pub=orders.eu.>, orders.us.new;sub=events.eu.>")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &DownscopeRequest{
+		Roles: []string{"nats:publish"},
+		Pub:   []string{"orders.eu.>", "orders.us.new"},
+		Sub:   []string{"events.eu.>"},
+	}
+	if !reflect.DeepEqual(req, expected) {
+		t.Errorf("expected %+v, got %+v", expected, req)
+	}
+
+	if req, err := ParseDownscopeRequest("billing-service"); req != nil || err != nil {
+		t.Errorf("expected plain username to be ignored, got %+v, %v", req, err)
+	}
+	for _, bad := range []string{"roles=", "admin=true", "pub=orders.>;oops"} {
+		if _, err := ParseDownscopeRequest(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestSubjectCovers(t *testing.T) {
+	cases := []struct {
+		pattern, sub string
+		want         bool
+	}{
+		{">", "orders.eu.new", true},
+		{"orders.>", "orders.eu.>", true},
+		{"orders.>", "orders", false},
+		{"orders.*.new", "orders.eu.new", true},
+		{"orders.*.new", "orders.*.new", true},
+		{"orders.eu.new", "orders.*.new", false},
+		{"orders.*", "orders.>", false},
+		{"orders.eu.>", "orders.>", false},
+		{"orders.eu", "orders.eu", true},
+	}
+	for _, c := range cases {
+		if got := subjectCovers(c.pattern, c.sub); got != c.want {
+			t.Errorf("subjectCovers(%q, %q) = %v, want %v", c.pattern, c.sub, got, c.want)
+		}
+	}
+}
+
+func TestDownscope_NeverExceedsEntitlement(t *testing.T) {
+	claims := &OIDCClaims{Issuer: testIssuer, Subject: "svc", Scopes: []string{"nats:publish", "nats:subscribe"}}
+	req := &DownscopeRequest{
+		Pub: []string{"orders.eu.>", "payments.>", ">"},
+		Sub: []string{"events.>"},
+	}
+	inbox := InboxPrefix(claims.Issuer, claims.Subject) + ".>"
+
+	d := DefaultPolicy().Evaluate(claims, nil, nil)
+	req.Apply(d, inbox)
+	if !d.Allowed {
+		t.Fatalf("expected allowed decision, got %+v", d)
+	}
+
+	pub := append([]string(nil), d.Permissions.PubAllow...)
+	sort.Strings(pub)
+	// ">" intersects down to the token's own grants; payments.> is not granted.
+	if expected := []string{"events.>", "orders.>", "orders.eu.>"}; !reflect.DeepEqual(pub, expected) {
+		t.Errorf("expected pub %v, got %v", expected, pub)
+	}
+	sub := append([]string(nil), d.Permissions.SubAllow...)
+	sort.Strings(sub)
+	if expected := []string{inbox, "events.>"}; !reflect.DeepEqual(sub, expected) {
+		t.Errorf("expected sub %v with private inbox kept, got %v", expected, sub)
+	}
+}
+
+func TestDownscope_Roles(t *testing.T) {
+	claims := &OIDCClaims{Issuer: testIssuer, Subject: "svc", Scopes: []string{"nats:publish", "nats:subscribe"}}
+	req := &DownscopeRequest{Roles: []string{"nats:subscribe", "nats:admin"}}
+
+	scoped := *claims
+	scoped.Scopes = req.FilterScopes(claims.Scopes)
+	if !reflect.DeepEqual(scoped.Scopes, []string{"nats:subscribe"}) {
+		t.Fatalf("expected only held roles to survive, got %v", scoped.Scopes)
+	}
+	d := DefaultPolicy().Evaluate(&scoped, nil, nil)
+	if len(d.Permissions.PubAllow) != 0 {
+		t.Errorf("expected no pub after dropping nats:publish, got %v", d.Permissions.PubAllow)
+	}
+}
+
+func TestDownscope_NothingGrantedDenies(t *testing.T) {
+	claims := &OIDCClaims{Issuer: testIssuer, Subject: "svc", Scopes: []string{"nats:publish"}}
+	d := DefaultPolicy().Evaluate(claims, nil, nil)
+	(&DownscopeRequest{Pub: []string{"payments.>"}, Sub: []string{"payments.>"}}).Apply(d, "")
+	if d.Allowed {
+		t.Errorf("expected deny when nothing requested is granted, got %+v", d.Permissions)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// EntitlementMatrix lists, for every role a policy defines, the subjects it
+// may publish or subscribe to and the subjects it is denied. The policy
+// format has no role inheritance, so each row is a role's complete grant.
+type EntitlementMatrix struct {
+	Policy    string             `json:"policy"`
+	Fragments []string           `json:"fragments,omitempty"` // tenants whose fragments are merged
+	Subjects  []string           `json:"subjects"`
+	Roles     []*RoleEntitlement `json:"roles"`
+}
+
+// RoleEntitlement is one row of the matrix. Source is "scope" for a scope
+// mapping, "fragment:<tenant>" for a tenant fragment's scope and "grammar"
+// for a role expanded from the scope grammar.
+type RoleEntitlement struct {
+	Role       string                  `json:"role"`
+	Source     string                  `json:"source"`
+	Privileged bool                    `json:"privileged,omitempty"`
+	Assurance  *AssuranceRequirement   `json:"assurance,omitempty"`
+	Grants     map[string]*Entitlement `json:"grants"`
+}
+
+// Entitlement is one cell of the matrix. A subject may be both allowed and
+// denied in a direction, in which case NATS denies it. Wildcard flags an
+// allow on a subject containing "*" or ">"; Privileged flags an allow that
+// lifts a guardrail; Narrowed flags the shared reply inbox, which is
+// narrowed to the identity's private prefix when a user JWT is issued.
+type Entitlement struct {
+	PubAllow   bool `json:"pub_allow,omitempty"`
+	PubDeny    bool `json:"pub_deny,omitempty"`
+	SubAllow   bool `json:"sub_allow,omitempty"`
+	SubDeny    bool `json:"sub_deny,omitempty"`
+	Wildcard   bool `json:"wildcard,omitempty"`
+	Privileged bool `json:"privileged,omitempty"`
+	Narrowed   bool `json:"narrowed,omitempty"`
+}
+
+// BuildEntitlementMatrix resolves every role of the policy, with the given
+// tenant fragments merged in, on its own. Scope grammar roles are expanded
+// once per allowed prefix; scopes naming a longer subject under an allowed
+// prefix are covered by the prefix's row.
+func BuildEntitlementMatrix(base *Policy, fragments map[string]*PolicyFragment) *EntitlementMatrix {
+	policy := base
+	if len(fragments) > 0 {
+		policy = base.MergeFragments(fragments)
+	}
+	m := &EntitlementMatrix{Policy: policy.Meta.String(), Fragments: sortedKeys(fragments)}
+	subjects := map[string]bool{}
+	guardrails := policy.Guardrails.withDefaults()
+
+	add := func(role, source string, mapping ScopeMapping) {
+		perms := policy.ResolvePermissions([]string{role})
+		row := &RoleEntitlement{Role: role, Source: source, Privileged: mapping.Privileged, Assurance: mapping.Assurance, Grants: map[string]*Entitlement{}}
+		cell := func(subject string) *Entitlement {
+			subjects[subject] = true
+			if e, ok := row.Grants[subject]; ok {
+				return e
+			}
+			e := &Entitlement{}
+			row.Grants[subject] = e
+			return e
+		}
+		for _, s := range perms.PubAllow {
+			e := cell(s)
+			e.PubAllow = true
+			e.Wildcard = e.Wildcard || isWildcardSubject(s)
+			e.Privileged = e.Privileged || (mapping.Privileged && slices.Contains(guardrails.Pub, s))
+		}
+		for _, s := range perms.SubAllow {
+			e := cell(s)
+			e.SubAllow = true
+			if s == sharedInbox && !policy.SharedInboxes {
+				e.Narrowed = true
+			} else {
+				e.Wildcard = e.Wildcard || isWildcardSubject(s)
+			}
+			e.Privileged = e.Privileged || (mapping.Privileged && slices.Contains(guardrails.Sub, s))
+		}
+		for _, s := range perms.PubDeny {
+			cell(s).PubDeny = true
+		}
+		for _, s := range perms.SubDeny {
+			cell(s).SubDeny = true
+		}
+		m.Roles = append(m.Roles, row)
+	}
+
+	owner := map[string]string{}
+	for tenant, f := range fragments {
+		for scope := range f.Scopes {
+			owner[scope] = tenant
+		}
+	}
+	for _, role := range sortedKeys(policy.Scopes) {
+		source := "scope"
+		if tenant, ok := owner[role]; ok {
+			source = "fragment:" + tenant
+		}
+		add(role, source, policy.Scopes[role])
+	}
+	if g := policy.ScopeGrammar; g != nil {
+		for _, verb := range []string{"pub", "sub"} {
+			for _, prefix := range g.AllowedPrefixes {
+				add(g.Prefix+":"+verb+":"+prefix, "grammar", ScopeMapping{})
+			}
+		}
+	}
+
+	m.Subjects = sortedKeys(subjects)
+	return m
+}
+
+// isWildcardSubject reports whether s contains a "*" or ">" token.
+func isWildcardSubject(s string) bool {
+	for _, token := range strings.Split(s, ".") {
+		if token == "*" || token == ">" {
+			return true
+		}
+	}
+	return false
+}
+
+// cellText renders a cell as e.g. "pub sub [W]" or "sub deny-pub"; an empty
+// string means the role has no entitlement on the subject.
+func (e *Entitlement) cellText() string {
+	if e == nil {
+		return ""
+	}
+	var parts []string
+	for _, flag := range []struct {
+		set  bool
+		text string
+	}{
+		{e.PubAllow, "pub"}, {e.SubAllow, "sub"}, {e.PubDeny, "deny-pub"}, {e.SubDeny, "deny-sub"},
+		{e.Wildcard, "[W]"}, {e.Privileged, "[P]"}, {e.Narrowed, "[N]"},
+	} {
+		if flag.set {
+			parts = append(parts, flag.text)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// assuranceText renders a role's assurance requirement, e.g.
+// "amr=mfa|hwk min_acr=silver downgrade->prod:viewer".
+func (r *RoleEntitlement) assuranceText() string {
+	a := r.Assurance
+	if a == nil {
+		return ""
+	}
+	var parts []string
+	if len(a.AMR) > 0 {
+		parts = append(parts, "amr="+strings.Join(a.AMR, "|"))
+	}
+	if a.MinACR != "" {
+		parts = append(parts, "min_acr="+a.MinACR)
+	}
+	if a.OnFail == AssuranceDowngrade {
+		parts = append(parts, "downgrade->"+a.DowngradeTo)
+	} else {
+		parts = append(parts, "deny")
+	}
+	return strings.Join(parts, " ")
+}
+
+// WriteCSV writes the matrix with one row per role and one column per subject.
+func (m *EntitlementMatrix) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"role", "source", "privileged", "assurance"}, m.Subjects...)); err != nil {
+		return err
+	}
+	for _, r := range m.Roles {
+		record := []string{r.Role, r.Source, fmt.Sprint(r.Privileged), r.assuranceText()}
+		for _, s := range m.Subjects {
+			record = append(record, r.Grants[s].cellText())
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteMarkdown writes the matrix as a Markdown table with a legend.
+func (m *EntitlementMatrix) WriteMarkdown(w io.Writer) {
+	fmt.Fprintf(w, "# Entitlement matrix\n\nPolicy: %s\n\n", m.Policy)
+	if len(m.Fragments) > 0 {
+		fmt.Fprintf(w, "Tenant fragments: %s\n\n", strings.Join(m.Fragments, ", "))
+	}
+	fmt.Fprintln(w, "`pub`/`sub`: allowed, `deny-pub`/`deny-sub`: denied (a denied subject stays denied even where it is also allowed), `[W]`: wildcard grant, `[P]`: privileged grant lifting a guardrail, `[N]`: reply inbox narrowed to the identity's private `_INBOX.<hash>.>`.")
+	fmt.Fprintln(w)
+
+	header := append([]string{"Role", "Source", "Assurance"}, m.Subjects...)
+	for i, h := range header[3:] {
+		header[i+3] = "`" + h + "`"
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+	fmt.Fprintf(w, "|%s\n", strings.Repeat("---|", len(header)))
+	for _, r := range m.Roles {
+		role := "`" + r.Role + "`"
+		if r.Privileged {
+			role += " [P]"
+		}
+		cells := []string{role, r.Source, r.assuranceText()}
+		for _, s := range m.Subjects {
+			cells = append(cells, r.Grants[s].cellText())
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+	}
+}
+
+// runEntitlements implements the "entitlements" command.
+func runEntitlements(args []string) int {
+	fs := flag.NewFlagSet("entitlements", flag.ContinueOnError)
+	policyFile := fs.String("policy", "", "Policy file; the built-in policy when no source is given")
+	configMap := fs.String("configmap", "", "Read the live policy from a ConfigMap (namespace/name)")
+	configMapKey := fs.String("configmap-key", "", "ConfigMap data key holding the policy (default "+DefaultConfigMapKey+")")
+	resource := fs.String("resource", "", "Read the live policy from an AuthPolicy resource (namespace/name)")
+	fragmentsBucket := fs.String("fragments-bucket", "", "Merge the tenant fragments in this NATS KV bucket")
+	trustedKeys := fs.String("trusted-keys", os.Getenv("POLICY_TRUSTED_KEYS"), "Keys trusted to sign the policy, as POLICY_TRUSTED_KEYS")
+	fragmentTrustedKeys := fs.String("fragment-trusted-keys", os.Getenv("POLICY_FRAGMENT_TRUSTED_KEYS"), "Keys trusted to sign fragments, as POLICY_FRAGMENT_TRUSTED_KEYS")
+	natsURL := fs.String("nats-url", envOrDefault("NATS_URL", nats.DefaultURL), "NATS server holding the fragments bucket")
+	natsUser := fs.String("nats-user", os.Getenv("NATS_USER"), "NATS user")
+	natsPassword := fs.String("nats-password", os.Getenv("NATS_PASSWORD"), "NATS password")
+	natsCA := fs.String("nats-ca", os.Getenv("TLS_CA_FILE"), "CA file for a TLS NATS connection")
+	format := fs.String("format", "markdown", "Output format: csv|json|markdown")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: auth-service entitlements [-policy <file> | -configmap <ns/name> | -resource <ns/name>] [-fragments-bucket <bucket>] [-format csv|json|markdown]")
+		fmt.Fprintln(fs.Output(), "Exports the role x subject entitlement matrix of a policy.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *policyFile != "" && (*configMap != "" || *resource != "") {
+		fmt.Fprintln(os.Stderr, "-policy cannot be combined with -configmap or -resource")
+		return 2
+	}
+	// Load only what the service would accept under the same trusted keys.
+	var trust, fragmentTrust *PolicyTrust
+	var err error
+	if *trustedKeys != "" {
+		if trust, err = ParsePolicyTrust(*trustedKeys); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if *fragmentTrustedKeys != "" {
+		if fragmentTrust, err = ParsePolicyTrust(*fragmentTrustedKeys); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	policy := DefaultPolicy()
+	switch {
+	case *configMap != "" || *resource != "":
+		var src *KubePolicySource
+		src, err = newKubePolicySource(*configMap, *configMapKey, *resource, trust)
+		if err == nil {
+			policy, err = src.Start(ctx)
+		}
+	case *policyFile != "":
+		policy, err = LoadPolicy(*policyFile, trust)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var fragments map[string]*PolicyFragment
+	if *fragmentsBucket != "" {
+		opts := []nats.Option{nats.Name("auth-service entitlements")}
+		if *natsUser != "" {
+			opts = append(opts, nats.UserInfo(*natsUser, *natsPassword))
+		}
+		if *natsCA != "" {
+			opts = append(opts, nats.RootCAs(*natsCA))
+		}
+		fragments, err = loadFragments(ctx, *natsURL, opts, *fragmentsBucket, policy, fragmentTrust)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	matrix := BuildEntitlementMatrix(policy, fragments)
+
+	switch *format {
+	case "csv":
+		if err := matrix.WriteCSV(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(matrix); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "markdown":
+		matrix.WriteMarkdown(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+	return 0
+}
+
+// loadFragments reads the tenant fragments in bucket that are valid against
+// policy and, with a non-nil trust set, signed by one of its keys, as the
+// service would merge them. Rejected fragments are logged.
+func loadFragments(ctx context.Context, url string, opts []nats.Option, bucket string, policy *Policy, trust *PolicyTrust) (map[string]*PolicyFragment, error) {
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS at %s: %w", url, err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind KV bucket %s: %w", bucket, err)
+	}
+
+	// Watch returns once the bucket's current contents are loaded.
+	watchCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	loader := NewFragmentLoader(policy, NewPolicyStore(policy), trust)
+	if err := loader.Watch(watchCtx, kv); err != nil {
+		return nil, err
+	}
+	return loader.Fragments(), nil
+}
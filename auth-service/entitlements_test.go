@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestBuildEntitlementMatrix(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{
+		"scopes": {
+			"nats:orders":  {"pub_allow": ["orders.new", "orders.admin.>"], "pub_deny": ["orders.admin.>"], "sub_allow": ["orders.>", "_INBOX.>"]},
+			"nats:sys-ops": {"sub_allow": ["$SYS.>"], "privileged": true, "assurance": {"amr": ["mfa"], "min_acr": "gold"}}
+		},
+		"acr_levels": ["silver", "gold"],
+		"scope_grammar": {"prefix": "nats", "allowed_prefixes": ["events"]},
+		"tenants": {"acme": {"prefix": "tenants.acme"}}
+	}`))
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	fragments := map[string]*PolicyFragment{
+		"acme": {Scopes: map[string]ScopeMapping{"acme:reader": {SubAllow: []string{"tenants.acme.>"}}}},
+	}
+	m := BuildEntitlementMatrix(policy, fragments)
+
+	rows := map[string]*RoleEntitlement{}
+	for _, r := range m.Roles {
+		rows[r.Role] = r
+	}
+	if len(rows) != 5 {
+		t.Fatalf("expected 2 scope, 1 fragment and 2 grammar roles, got %d", len(rows))
+	}
+
+	orders := rows["nats:orders"]
+	if e := orders.Grants["orders.new"]; !e.PubAllow || e.Wildcard {
+		t.Errorf("expected literal pub allow on orders.new, got %+v", e)
+	}
+	if e := orders.Grants["orders.>"]; !e.SubAllow || !e.Wildcard {
+		t.Errorf("expected wildcard sub allow on orders.>, got %+v", e)
+	}
+	if e := orders.Grants["orders.admin.>"]; !e.PubAllow || !e.PubDeny {
+		t.Errorf("expected both the allow and the scope deny on orders.admin.>, got %+v", e)
+	}
+	if e := orders.Grants["$SYS.>"]; !e.PubDeny || !e.SubDeny {
+		t.Errorf("expected guardrail denies, got %+v", e)
+	}
+	if e := orders.Grants["_INBOX.>"]; !e.Narrowed || e.Wildcard || e.cellText() != "sub [N]" {
+		t.Errorf("expected narrowed inbox, got %+v", e)
+	}
+
+	sys := rows["nats:sys-ops"]
+	if e := sys.Grants["$SYS.>"]; !e.SubAllow || !e.Privileged || !e.PubDeny {
+		t.Errorf("expected privileged sub grant with pub guardrail kept, got %+v", e)
+	}
+	if got := sys.assuranceText(); got != "amr=mfa min_acr=gold deny" {
+		t.Errorf("unexpected assurance %q", got)
+	}
+
+	if r := rows["acme:reader"]; r == nil || r.Source != "fragment:acme" || !r.Grants["tenants.acme.>"].SubAllow {
+		t.Errorf("expected fragment role granting tenants.acme.>, got %+v", r)
+	}
+	if len(m.Fragments) != 1 || m.Fragments[0] != "acme" {
+		t.Errorf("expected merged fragments to be listed, got %v", m.Fragments)
+	}
+
+	grammar := rows["nats:pub:events"]
+	if grammar == nil || grammar.Source != "grammar" || !grammar.Grants["events.>"].PubAllow {
+		t.Errorf("expected grammar role granting events.>, got %+v", grammar)
+	}
+}
+
+func TestLoadFragments(t *testing.T) {
+	nc, js := runJetStream(t)
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "policy-fragments"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.Put("acme", []byte(`{"scopes": {"acme:reader": {"sub_allow": ["tenants.acme.>"]}}}`))
+	kv.Put("globex", []byte(`{"scopes": {"globex:reader": {"sub_allow": [">"]}}}`))
+
+	fragments, err := loadFragments(context.Background(), nc.ConnectedUrl(), nil, "policy-fragments", tenantBasePolicy(t), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fragments) != 1 || fragments["acme"] == nil {
+		t.Errorf("expected only the valid acme fragment, got %v", fragments)
+	}
+}
+
+func TestEntitlementMatrix_WriteCSV(t *testing.T) {
+	var b strings.Builder
+	if err := BuildEntitlementMatrix(DefaultPolicy(), nil).WriteCSV(&b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1+len(DefaultScopeMappings) {
+		t.Fatalf("expected header and %d roles, got:\n%s", len(DefaultScopeMappings), b.String())
+	}
+	if !strings.HasPrefix(lines[1], "nats:admin,scope,false,,") || !strings.Contains(lines[1], "pub sub [W]") {
+		t.Errorf("unexpected admin row: %s", lines[1])
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nkeys"
+)
+
+// BreakGlassUser is a static nkey user rendered into the fallback server
+// config, holding the permissions the policy grants to its roles.
+type BreakGlassUser struct {
+	Name  string   `json:"name"`
+	NKey  string   `json:"nkey"`
+	Roles []string `json:"roles"`
+}
+
+// LoadBreakGlassUsers reads a JSON array of break-glass users.
+func LoadBreakGlassUsers(path string) ([]BreakGlassUser, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read break-glass users %s: %w", path, err)
+	}
+	var users []BreakGlassUser
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("failed to parse break-glass users: %w", err)
+	}
+	return users, nil
+}
+
+// WriteFallbackConfig renders the users as an accounts block for the
+// policy's account. Each user's permissions are exactly those returned by
+// ResolvePermissions for its roles, with the response permission the
+// callout service issues. The rendered block does not include the private
+// inbox narrowing applied to OIDC identities.
+func WriteFallbackConfig(w io.Writer, policy *Policy, users []BreakGlassUser) error {
+	if len(users) == 0 {
+		return fmt.Errorf("no break-glass users")
+	}
+	seen := map[string]bool{}
+	for _, u := range users {
+		if u.Name == "" {
+			return fmt.Errorf("break-glass user without a name")
+		}
+		if !nkeys.IsValidPublicUserKey(u.NKey) {
+			return fmt.Errorf("break-glass user %s: invalid user nkey %q", u.Name, u.NKey)
+		}
+		if seen[u.NKey] {
+			return fmt.Errorf("break-glass user %s: nkey already used", u.Name)
+		}
+		seen[u.NKey] = true
+		for _, role := range u.Roles {
+			if _, ok := policy.Scopes[role]; ok {
+				continue
+			}
+			if _, ok := policy.grammarMapping(role); !ok {
+				return fmt.Errorf("break-glass user %s: role %q is not defined by the policy", u.Name, role)
+			}
+		}
+		if !policy.ResolvePermissions(u.Roles).HasPermissions() {
+			return fmt.Errorf("break-glass user %s: roles grant no permissions", u.Name)
+		}
+	}
+
+	fmt.Fprintf(w, "# Break-glass users generated from policy %s.\n", policy.Meta)
+	fmt.Fprintf(w, "# To apply, replace the %s account entry with this block and remove\n", policy.Account)
+	fmt.Fprintln(w, "# authorization.auth_callout so the server stops calling the auth service.")
+	fmt.Fprintln(w, "accounts {")
+	fmt.Fprintf(w, "  %s: {\n", confString(policy.Account))
+	fmt.Fprintln(w, "    users: [")
+	for _, u := range users {
+		perms := policy.ResolvePermissions(u.Roles)
+		fmt.Fprintf(w, "      # %s: %s\n", u.Name, strings.Join(u.Roles, ", "))
+		fmt.Fprintln(w, "      {")
+		fmt.Fprintf(w, "        nkey: %s\n", confString(u.NKey))
+		fmt.Fprintln(w, "        permissions: {")
+		writeConfPermission(w, "publish", perms.PubAllow, perms.PubDeny)
+		writeConfPermission(w, "subscribe", perms.SubAllow, perms.SubDeny)
+		fmt.Fprintf(w, "          allow_responses: { max: %d, expires: %s }\n",
+			responsePermission.MaxMsgs, confString(responsePermission.Expires.String()))
+		fmt.Fprintln(w, "        }")
+		fmt.Fprintln(w, "      }")
+	}
+	fmt.Fprintln(w, "    ]")
+	fmt.Fprintln(w, "  }")
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+// writeConfPermission writes one direction, omitting empty lists so the
+// server applies the same defaults it applies to the issued user JWTs.
+func writeConfPermission(w io.Writer, name string, allow, deny []string) {
+	var parts []string
+	if len(allow) > 0 {
+		parts = append(parts, "allow: "+confList(allow))
+	}
+	if len(deny) > 0 {
+		parts = append(parts, "deny: "+confList(deny))
+	}
+	if len(parts) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "          %s: { %s }\n", name, strings.Join(parts, ", "))
+}
+
+func confList(subjects []string) string {
+	quoted := make([]string, len(subjects))
+	for i, s := range subjects {
+		quoted[i] = confString(s)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// confString quotes s so the config parser neither expands variables nor
+// splits it on special characters.
+func confString(s string) string {
+	return strconv.Quote(s)
+}
+
+// runFallbackConfig implements the "fallback-config" command.
+func runFallbackConfig(args []string) int {
+	fs := flag.NewFlagSet("fallback-config", flag.ContinueOnError)
+	policyFile := fs.String("policy", "", "Policy file; the built-in policy when empty")
+	usersFile := fs.String("users", "", "JSON array of break-glass users with name, nkey and roles (required)")
+	out := fs.String("out", "-", "Config output file; \"-\" writes stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: auth-service fallback-config -users <file> [-policy <file>] [-out <file>]")
+		fmt.Fprintln(fs.Output(), "Renders a static accounts block for break-glass nkey users from the policy.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *usersFile == "" {
+		fs.Usage()
+		return 2
+	}
+
+	policy := DefaultPolicy()
+	if *policyFile != "" {
+		var err error
+		policy, err = LoadPolicy(*policyFile, nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	users, err := LoadBreakGlassUsers(*usersFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var b strings.Builder
+	if err := WriteFallbackConfig(&b, policy, users); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *out == "-" {
+		fmt.Print(b.String())
+	} else if err := os.WriteFile(*out, []byte(b.String()), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write config: %v\n", err)
+		return 1
+	}
+	return 0
+}
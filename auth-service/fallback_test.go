@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/conf"
+	"github.com/nats-io/nkeys"
+)
+
+func TestWriteFallbackConfig_MatchesResolvePermissions(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{
+		"scopes": {
+			"nats:admin":   {"pub_allow": [">"], "sub_allow": [">"]},
+			"nats:orders":  {"pub_allow": ["orders.>"], "pub_deny": ["orders.admin.>"], "sub_allow": ["_INBOX.>"]},
+			"nats:sys-ops": {"sub_allow": ["$SYS.>"], "privileged": true}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	users := []BreakGlassUser{
+		{Name: "ops", NKey: testUserNKey(t), Roles: []string{"nats:admin", "nats:sys-ops"}},
+		{Name: "orders", NKey: testUserNKey(t), Roles: []string{"nats:orders"}},
+	}
+
+	var b strings.Builder
+	if err := WriteFallbackConfig(&b, policy, users); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg, err := conf.Parse(b.String())
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v\n%s", err, b.String())
+	}
+
+	account := cfg["accounts"].(map[string]any)[DefaultAccount].(map[string]any)
+	entries := account["users"].([]any)
+	if len(entries) != len(users) {
+		t.Fatalf("expected %d users, got %d", len(users), len(entries))
+	}
+	for i, u := range users {
+		entry := entries[i].(map[string]any)
+		if entry["nkey"] != u.NKey {
+			t.Errorf("user %s: expected nkey %s, got %v", u.Name, u.NKey, entry["nkey"])
+		}
+		perms := entry["permissions"].(map[string]any)
+		pub, _ := perms["publish"].(map[string]any)
+		sub, _ := perms["subscribe"].(map[string]any)
+		got := &ResolvedPermissions{
+			PubAllow: stringList(pub["allow"]),
+			PubDeny:  stringList(pub["deny"]),
+			SubAllow: stringList(sub["allow"]),
+			SubDeny:  stringList(sub["deny"]),
+		}
+		if expected := policy.ResolvePermissions(u.Roles); !reflect.DeepEqual(got, expected) {
+			t.Errorf("user %s: expected %+v, got %+v", u.Name, expected, got)
+		}
+	}
+}
+
+func TestWriteFallbackConfig_RejectsUnknownRole(t *testing.T) {
+	users := []BreakGlassUser{{Name: "ops", NKey: testUserNKey(t), Roles: []string{"nats:root"}}}
+	if err := WriteFallbackConfig(&strings.Builder{}, DefaultPolicy(), users); err == nil {
+		t.Error("expected an error for a role the policy does not define")
+	}
+}
+
+func testUserNKey(t *testing.T) string {
+	t.Helper()
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatalf("create user key: %v", err)
+	}
+	pub, _ := kp.PublicKey()
+	return pub
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// TenantConfig declares a tenant that may manage its own policy fragment.
+type TenantConfig struct {
+	// Prefix is the subject space owned by the tenant, e.g. "tenants.acme".
+	Prefix string `json:"prefix"`
+}
+
+// PolicyFragment is a tenant-owned set of scope mappings.
+type PolicyFragment struct {
+	Scopes map[string]ScopeMapping `json:"scopes"`
+}
+
+// ValidateFragment checks that a tenant's fragment only defines scopes named
+// "<tenant>:..." and only grants or denies subjects under the tenant's prefix. The
+// private reply inbox ("_INBOX.>") may also be granted for subscribe, since it
+// is narrowed per identity. Assurance requirements may only downgrade to
+// another scope of the same fragment.
+func (p *Policy) ValidateFragment(tenant string, f *PolicyFragment) error {
+	cfg, ok := p.Tenants[tenant]
+	if !ok {
+		return fmt.Errorf("unknown tenant %q", tenant)
+	}
+	if len(f.Scopes) == 0 {
+		return fmt.Errorf("tenant %s: fragment defines no scopes", tenant)
+	}
+	for scope, m := range f.Scopes {
+		if !strings.HasPrefix(scope, tenant+":") {
+			return fmt.Errorf("tenant %s: scope %q must be named %q", tenant, scope, tenant+":<role>")
+		}
+		if _, exists := p.Scopes[scope]; exists {
+			return fmt.Errorf("tenant %s: scope %q is already defined by the base policy", tenant, scope)
+		}
+		if m.Privileged {
+			return fmt.Errorf("tenant %s: scope %q may not be privileged", tenant, scope)
+		}
+		if a := m.Assurance; a != nil {
+			if a.DowngradeTo != "" && !strings.HasPrefix(a.DowngradeTo, tenant+":") {
+				return fmt.Errorf("tenant %s: scope %q may not downgrade to %q", tenant, scope, a.DowngradeTo)
+			}
+			if err := p.withScopes(f.Scopes).validateAssurance(scope, a); err != nil {
+				return fmt.Errorf("tenant %s: %w", tenant, err)
+			}
+		}
+		for _, s := range m.PubAllow {
+			if !underPrefix(cfg.Prefix, s) {
+				return fmt.Errorf("tenant %s: scope %q grants pub %q outside %s", tenant, scope, s, cfg.Prefix)
+			}
+		}
+		for _, s := range m.SubAllow {
+			if s == sharedInbox && !p.SharedInboxes {
+				continue
+			}
+			if !underPrefix(cfg.Prefix, s) {
+				return fmt.Errorf("tenant %s: scope %q grants sub %q outside %s", tenant, scope, s, cfg.Prefix)
+			}
+		}
+		for _, s := range m.PubDeny {
+			if !underPrefix(cfg.Prefix, s) {
+				return fmt.Errorf("tenant %s: scope %q denies pub %q outside %s", tenant, scope, s, cfg.Prefix)
+			}
+		}
+		for _, s := range m.SubDeny {
+			if !underPrefix(cfg.Prefix, s) {
+				return fmt.Errorf("tenant %s: scope %q denies sub %q outside %s", tenant, scope, s, cfg.Prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// underPrefix reports whether subject lies within prefix's subject space.
+func underPrefix(prefix, subject string) bool {
+	return subject == prefix || subjectCovers(prefix+".>", subject)
+}
+
+// MergeFragments returns a new policy with the scopes of every fragment added
+// to the base policy. Fragments must already be validated.
+func (p *Policy) MergeFragments(fragments map[string]*PolicyFragment) *Policy {
+	scopes := make(map[string]ScopeMapping, len(p.Scopes))
+	for k, v := range p.Scopes {
+		scopes[k] = v
+	}
+	for _, f := range fragments {
+		for k, v := range f.Scopes {
+			scopes[k] = v
+		}
+	}
+	return p.withScopes(scopes)
+}
+
+// FragmentLoader keeps the active policy in sync with the base policy plus
+// the tenant fragments stored in a NATS KV bucket, one key per tenant. When a
+// shadow candidate is set, the fragments are merged into it as well.
+type FragmentLoader struct {
+	base      *Policy
+	candidate *Policy
+	policies  *PolicyStore
+	trust     *PolicyTrust
+
+	mu        sync.Mutex
+	fragments map[string]*PolicyFragment
+	versions  map[string]PolicyMeta // last accepted per tenant, kept after removal
+}
+
+// NewFragmentLoader creates a loader that publishes merged policies to
+// policies. With a non-nil trust set, fragments must be bundles signed for
+// their tenant by one of its keys, which should differ from the keys trusted
+// for the base policy.
+func NewFragmentLoader(base *Policy, policies *PolicyStore, trust *PolicyTrust) *FragmentLoader {
+	return &FragmentLoader{
+		base:      base,
+		policies:  policies,
+		trust:     trust,
+		fragments: make(map[string]*PolicyFragment),
+		versions:  make(map[string]PolicyMeta),
+	}
+}
+
+// Put validates and stores a tenant's fragment, then republishes the merged
+// policy. An invalid fragment, or a signed fragment older than the last one
+// accepted for the tenant, is rejected and the tenant's previous fragment, if
+// any, stays in effect.
+func (l *FragmentLoader) Put(tenant string, data []byte) error {
+	target := BundleTarget{Kind: BundleFragment, Tenant: tenant}
+	doc, meta, err := OpenPolicyDocument(data, "fragment:"+tenant, l.trust, target)
+	if err != nil {
+		return fmt.Errorf("tenant %s: %w", tenant, err)
+	}
+	var f PolicyFragment
+	if err := json.Unmarshal(doc, &f); err != nil {
+		return fmt.Errorf("tenant %s: failed to parse fragment: %w", tenant, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := checkVersion(meta, l.versions[tenant]); err != nil {
+		return fmt.Errorf("tenant %s: %w", tenant, err)
+	}
+	if err := l.base.ValidateFragment(tenant, &f); err != nil {
+		return err
+	}
+	l.versions[tenant] = meta
+	log.Printf("Accepted policy fragment for tenant %s: %s", tenant, meta)
+	if l.candidate != nil {
+		if err := l.candidate.ValidateFragment(tenant, &f); err != nil {
+			log.Printf("Candidate policy would reject the fragment: %v", err)
+		}
+	}
+	l.fragments[tenant] = &f
+	l.publish()
+	return nil
+}
+
+// SetBase replaces the base policy and republishes the merged policy.
+// Fragments that are no longer valid against the new base are dropped until
+// their tenant writes a new revision.
+func (l *FragmentLoader) SetBase(base *Policy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.base = base
+	for tenant, f := range l.fragments {
+		if err := base.ValidateFragment(tenant, f); err != nil {
+			log.Printf("Dropped policy fragment after base policy change: %v", err)
+			delete(l.fragments, tenant)
+		}
+	}
+	l.publish()
+}
+
+// SetCandidate sets the shadow candidate policy and republishes it merged
+// with the fragments in effect, so the candidate is compared against the
+// active policy on equal terms. Fragments the candidate would reject are left
+// out of it.
+func (l *FragmentLoader) SetCandidate(candidate *Policy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.candidate = candidate
+	l.publish()
+}
+
+// Delete removes a tenant's fragment and republishes the merged policy.
+func (l *FragmentLoader) Delete(tenant string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.fragments, tenant)
+	l.publish()
+}
+
+// Fragments returns the fragments in effect, keyed by tenant.
+func (l *FragmentLoader) Fragments() map[string]*PolicyFragment {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]*PolicyFragment, len(l.fragments))
+	for tenant, f := range l.fragments {
+		out[tenant] = f
+	}
+	return out
+}
+
+// Tenants returns the tenants with a fragment in effect.
+func (l *FragmentLoader) Tenants() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tenants := make([]string, 0, len(l.fragments))
+	for t := range l.fragments {
+		tenants = append(tenants, t)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+func (l *FragmentLoader) publish() {
+	merged := l.base.MergeFragments(l.fragments)
+	merged.compiled()
+	l.policies.SetActive(merged)
+
+	if l.candidate == nil {
+		return
+	}
+	accepted := make(map[string]*PolicyFragment, len(l.fragments))
+	for tenant, f := range l.fragments {
+		if l.candidate.ValidateFragment(tenant, f) == nil {
+			accepted[tenant] = f
+		}
+	}
+	candidate := l.candidate.MergeFragments(accepted)
+	candidate.compiled()
+	l.policies.SetCandidate(candidate)
+}
+
+// Watch mirrors the fragments bucket into the active policy. It returns once
+// the initial fragments have been loaded and keeps applying updates in the
+// background until ctx is cancelled.
+func (l *FragmentLoader) Watch(ctx context.Context, kv nats.KeyValue) error {
+	apply := func(entry nats.KeyValueEntry) {
+		tenant := entry.Key()
+		switch entry.Operation() {
+		case nats.KeyValueDelete, nats.KeyValuePurge:
+			l.Delete(tenant)
+			log.Printf("Removed policy fragment for tenant %s", tenant)
+		default:
+			if err := l.Put(tenant, entry.Value()); err != nil {
+				log.Printf("Rejected policy fragment revision %d: %v", entry.Revision(), err)
+				return
+			}
+			log.Printf("Loaded policy fragment for tenant %s (revision %d)", tenant, entry.Revision())
+		}
+	}
+
+	if err := watchKV(ctx, kv, apply); err != nil {
+		return fmt.Errorf("failed to watch fragments bucket %s: %w", kv.Bucket(), err)
+	}
+	return nil
+}
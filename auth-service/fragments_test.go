@@ -0,0 +1,233 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+)
+
+func tenantBasePolicy(t *testing.T) *Policy {
+	t.Helper()
+	policy, err := ParsePolicy([]byte(`{
+		"scopes": {"nats:admin": {"pub_allow": [">"], "sub_allow": [">"]}},
+		"tenants": {
+			"acme":   {"prefix": "tenants.acme"},
+			"globex": {"prefix": "tenants.globex"}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return policy
+}
+
+func TestValidateFragment(t *testing.T) {
+	base := tenantBasePolicy(t)
+	valid := &PolicyFragment{Scopes: map[string]ScopeMapping{
+		"acme:writer": {PubAllow: []string{"tenants.acme.orders.>"}, SubAllow: []string{"_INBOX.>"}},
+		"acme:reader": {SubAllow: []string{"tenants.acme.>"}, PubDeny: []string{"tenants.acme.>"}, SubDeny: []string{"tenants.acme.secrets.>"}},
+		"acme:ops": {
+			PubAllow:  []string{"tenants.acme.>"},
+			Assurance: &AssuranceRequirement{AMR: []string{"mfa"}, OnFail: AssuranceDowngrade, DowngradeTo: "acme:reader"},
+		},
+	}}
+	if err := base.ValidateFragment("acme", valid); err != nil {
+		t.Errorf("expected valid fragment, got %v", err)
+	}
+
+	invalid := map[string]*PolicyFragment{
+		"other tenant subject": {Scopes: map[string]ScopeMapping{"acme:x": {PubAllow: []string{"tenants.globex.>"}}}},
+		"prefix lookalike":     {Scopes: map[string]ScopeMapping{"acme:x": {SubAllow: []string{"tenants.acmecorp.>"}}}},
+		"full wildcard":        {Scopes: map[string]ScopeMapping{"acme:x": {SubAllow: []string{">"}}}},
+		"tenant wildcard":      {Scopes: map[string]ScopeMapping{"acme:x": {SubAllow: []string{"tenants.*.orders"}}}},
+		"foreign scope name":   {Scopes: map[string]ScopeMapping{"globex:x": {SubAllow: []string{"tenants.acme.>"}}}},
+		"base scope name":      {Scopes: map[string]ScopeMapping{"nats:admin": {SubAllow: []string{"tenants.acme.>"}}}},
+		"privileged":           {Scopes: map[string]ScopeMapping{"acme:x": {SubAllow: []string{"tenants.acme.>"}, Privileged: true}}},
+		"empty":                {},
+		"downgrade to base":    {Scopes: map[string]ScopeMapping{"acme:x": {Assurance: &AssuranceRequirement{AMR: []string{"never"}, OnFail: AssuranceDowngrade, DowngradeTo: "nats:admin"}}}},
+		"downgrade to tenant":  {Scopes: map[string]ScopeMapping{"acme:x": {Assurance: &AssuranceRequirement{AMR: []string{"never"}, OnFail: AssuranceDowngrade, DowngradeTo: "globex:admin"}}}},
+		"downgrade undefined":  {Scopes: map[string]ScopeMapping{"acme:x": {Assurance: &AssuranceRequirement{AMR: []string{"never"}, OnFail: AssuranceDowngrade, DowngradeTo: "acme:missing"}}}},
+		"invalid assurance":    {Scopes: map[string]ScopeMapping{"acme:x": {Assurance: &AssuranceRequirement{}}}},
+		"pub deny outside":     {Scopes: map[string]ScopeMapping{"acme:x": {SubAllow: []string{"tenants.acme.>"}, PubDeny: []string{"tenants.globex.>"}}}},
+		"sub deny wildcard":    {Scopes: map[string]ScopeMapping{"acme:x": {SubAllow: []string{"tenants.acme.>"}, SubDeny: []string{">"}}}},
+	}
+	for name, f := range invalid {
+		if err := base.ValidateFragment("acme", f); err == nil {
+			t.Errorf("%s: expected fragment to be rejected", name)
+		}
+	}
+	if err := base.ValidateFragment("initech", valid); err == nil {
+		t.Error("expected unknown tenant to be rejected")
+	}
+}
+
+func TestFragmentLoader(t *testing.T) {
+	base := tenantBasePolicy(t)
+	policies := NewPolicyStore(base)
+	loader := NewFragmentLoader(base, policies, nil)
+
+	if err := loader.Put("acme", []byte(`{"scopes": {"acme:reader": {"sub_allow": ["tenants.acme.>"]}}}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p := policies.Active().ResolvePermissions([]string{"acme:reader"})
+	if !reflect.DeepEqual(p.SubAllow, []string{"tenants.acme.>"}) {
+		t.Errorf("expected merged tenant scope, got %v", p.SubAllow)
+	}
+	if _, ok := base.Scopes["acme:reader"]; ok {
+		t.Error("expected base policy to be left unchanged")
+	}
+
+	// An invalid revision is rejected and the previous fragment stays in effect.
+	err := loader.Put("acme", []byte(`{"scopes": {"acme:reader": {"sub_allow": [">"]}}}`))
+	if err == nil || !strings.Contains(err.Error(), "outside tenants.acme") {
+		t.Fatalf("expected prefix violation, got %v", err)
+	}
+	p = policies.Active().ResolvePermissions([]string{"acme:reader"})
+	if !reflect.DeepEqual(p.SubAllow, []string{"tenants.acme.>"}) {
+		t.Errorf("expected previous fragment to remain, got %v", p.SubAllow)
+	}
+
+	loader.Delete("acme")
+	if p := policies.Active().ResolvePermissions([]string{"acme:reader"}); p.HasPermissions() {
+		t.Errorf("expected tenant scope to be removed, got %v", p.SubAllow)
+	}
+}
+
+func TestFragmentLoader_SetBase(t *testing.T) {
+	base := tenantBasePolicy(t)
+	policies := NewPolicyStore(base)
+	loader := NewFragmentLoader(base, policies, nil)
+	for _, tenant := range []string{"acme", "globex"} {
+		doc := `{"scopes": {"` + tenant + `:reader": {"sub_allow": ["tenants.` + tenant + `.>"]}}}`
+		if err := loader.Put(tenant, []byte(doc)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// The new base no longer declares globex, so its fragment is dropped.
+	next, err := ParsePolicy([]byte(`{
+		"scopes": {"nats:ops": {"sub_allow": ["ops.>"]}},
+		"tenants": {"acme": {"prefix": "tenants.acme"}}
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	loader.SetBase(next)
+
+	if !reflect.DeepEqual(loader.Tenants(), []string{"acme"}) {
+		t.Errorf("expected only acme to remain, got %v", loader.Tenants())
+	}
+	active := policies.Active()
+	if !active.ResolvePermissions([]string{"nats:ops"}).HasPermissions() || !active.ResolvePermissions([]string{"acme:reader"}).HasPermissions() {
+		t.Error("expected merged policy to combine the new base with the acme fragment")
+	}
+}
+
+func TestFragmentLoader_Candidate(t *testing.T) {
+	base := tenantBasePolicy(t)
+	policies := NewPolicyStore(base)
+	loader := NewFragmentLoader(base, policies, nil)
+	candidate, err := ParsePolicy([]byte(`{
+		"scopes": {"nats:admin": {"pub_allow": ["admin.>"]}},
+		"tenants": {"acme": {"prefix": "tenants.acme"}}
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	loader.SetCandidate(candidate)
+	for _, tenant := range []string{"acme", "globex"} {
+		doc := `{"scopes": {"` + tenant + `:reader": {"sub_allow": ["tenants.` + tenant + `.>"]}}}`
+		if err := loader.Put(tenant, []byte(doc)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	shadow := policies.Candidate()
+	if !shadow.ResolvePermissions([]string{"acme:reader"}).HasPermissions() {
+		t.Error("expected the acme fragment to be merged into the candidate")
+	}
+	// The candidate no longer declares globex, so it would not accept its fragment.
+	if shadow.ResolvePermissions([]string{"globex:reader"}).HasPermissions() {
+		t.Error("expected the globex fragment to be left out of the candidate")
+	}
+	if !reflect.DeepEqual(shadow.ResolvePermissions([]string{"nats:admin"}).PubAllow, []string{"admin.>"}) {
+		t.Error("expected the candidate's own scopes to be kept")
+	}
+	if !policies.Active().ResolvePermissions([]string{"globex:reader"}).HasPermissions() {
+		t.Error("expected the active policy to keep the globex fragment")
+	}
+
+	loader.Delete("acme")
+	if policies.Candidate().ResolvePermissions([]string{"acme:reader"}).HasPermissions() {
+		t.Error("expected deleted fragments to leave the candidate")
+	}
+}
+
+func TestFragmentLoader_SignedFragments(t *testing.T) {
+	base := tenantBasePolicy(t)
+	policies := NewPolicyStore(base)
+	kp, _ := nkeys.CreateAccount()
+	pub, _ := kp.PublicKey()
+	trust, _ := ParsePolicyTrust(pub)
+	loader := NewFragmentLoader(base, policies, trust)
+	fragment := func(tenant string, version uint64, subject string) []byte {
+		doc := `{"scopes": {"acme:reader": {"sub_allow": ["` + subject + `"]}}}`
+		return signedBundle(t, kp, BundleTarget{Kind: BundleFragment, Tenant: tenant}, version, doc)
+	}
+	subject := func() string {
+		return policies.Active().ResolvePermissions([]string{"acme:reader"}).SubAllow[0]
+	}
+
+	if err := loader.Put("acme", fragment("acme", 2, "tenants.acme.>")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := loader.Put("globex", fragment("acme", 3, "tenants.acme.>")); err == nil {
+		t.Error("expected a fragment signed for another tenant to be rejected")
+	}
+	if err := loader.Put("acme", fragment("acme", 1, "tenants.acme.orders.>")); err == nil || !strings.Contains(err.Error(), "older") {
+		t.Errorf("expected an older version to be rejected, got %v", err)
+	}
+	if subject() != "tenants.acme.>" {
+		t.Errorf("expected version 2 to stay in effect, got %s", subject())
+	}
+
+	// Removing a fragment does not reset its version.
+	loader.Delete("acme")
+	if err := loader.Put("acme", fragment("acme", 1, "tenants.acme.orders.>")); err == nil {
+		t.Error("expected an older version to be rejected after removal")
+	}
+	if err := loader.Put("acme", fragment("acme", 3, "tenants.acme.orders.>")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if subject() != "tenants.acme.orders.>" {
+		t.Errorf("expected version 3 to be in effect, got %s", subject())
+	}
+}
+
+func TestParsePolicy_InvalidTenant(t *testing.T) {
+	for _, doc := range []string{
+		`{"scopes": {"a": {}}, "tenants": {"acme": {"prefix": "tenants.*"}}}`,
+		`{"scopes": {"a": {}}, "tenants": {"ac:me": {"prefix": "tenants.acme"}}}`,
+	} {
+		if _, err := ParsePolicy([]byte(doc)); err == nil {
+			t.Errorf("expected error for %s", doc)
+		}
+	}
+}
+
+func TestFragmentLoader_AssuranceCannotEscalate(t *testing.T) {
+	base := tenantBasePolicy(t)
+	policies := NewPolicyStore(base)
+	loader := NewFragmentLoader(base, policies, nil)
+
+	escalating := `{"scopes": {"acme:ops": {"assurance": {"amr": ["never"], "on_fail": "downgrade", "downgrade_to": "nats:admin"}}}}`
+	if err := loader.Put("acme", []byte(escalating)); err == nil {
+		t.Fatal("expected a fragment downgrading to a base scope to be rejected")
+	}
+	d := policies.Active().Evaluate(&OIDCClaims{Issuer: testIssuer, Subject: "eve", Scopes: []string{"acme:ops"}}, nil, nil)
+	if d.Allowed {
+		t.Errorf("expected acme:ops to grant nothing, got %+v", d.Permissions)
+	}
+}
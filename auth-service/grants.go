@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// Admin API subjects for just-in-time elevation grants. They are served on
+// the auth service's own connection, so callers must be users of its account.
+const (
+	GrantCreateSubject = "auth.admin.grants.create"
+	GrantListSubject   = "auth.admin.grants.list"
+	GrantRevokeSubject = "auth.admin.grants.revoke"
+)
+
+// adminQueue is the queue group of every admin API subscription, so each
+// request is handled by exactly one replica.
+const adminQueue = "auth-admin"
+
+// DefaultGrantApproverScope is the scope an approver's token must carry.
+const DefaultGrantApproverScope = "nats:grant-approver"
+
+// Grant is a time-boxed elevation of one identity's permissions.
+type Grant struct {
+	ID        string    `json:"id"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	PubAllow  []string  `json:"pub_allow,omitempty"`
+	SubAllow  []string  `json:"sub_allow,omitempty"`
+	Reason    string    `json:"reason"`
+	Approver  string    `json:"approver"` // subject of the approver's token
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RevokedBy string    `json:"revoked_by,omitempty"` // set on the revoked audit event
+}
+
+// GrantRequest is the payload of a grant creation request. The approver is
+// identified by an OIDC token of their own rather than by name.
+type GrantRequest struct {
+	Issuer        string   `json:"issuer"`
+	Subject       string   `json:"subject"`
+	PubAllow      []string `json:"pub_allow,omitempty"`
+	SubAllow      []string `json:"sub_allow,omitempty"`
+	Duration      string   `json:"duration"`
+	Reason        string   `json:"reason"`
+	ApproverToken string   `json:"approver_token"`
+}
+
+// GrantRevokeRequest is the payload of a grant revocation request. Like
+// creation, revocation requires an approver token.
+type GrantRevokeRequest struct {
+	ID            string `json:"id"`
+	ApproverToken string `json:"approver_token"`
+}
+
+// GrantResponse is the reply to every grant admin request.
+type GrantResponse struct {
+	Grant  *Grant   `json:"grant,omitempty"`
+	Grants []*Grant `json:"grants,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// GrantStore mirrors the grants KV bucket in memory.
+type GrantStore struct {
+	mu     sync.Mutex
+	grants map[string]*Grant
+}
+
+// NewGrantStore creates an empty store.
+func NewGrantStore() *GrantStore {
+	return &GrantStore{grants: make(map[string]*Grant)}
+}
+
+// NewGrant validates a request approved by the holder of approver and builds
+// a grant starting at now.
+func NewGrant(req GrantRequest, approver *OIDCClaims, now time.Time, maxDuration time.Duration) (*Grant, error) {
+	if req.Issuer == "" || req.Subject == "" {
+		return nil, fmt.Errorf("issuer and subject are required")
+	}
+	if len(req.PubAllow) == 0 && len(req.SubAllow) == 0 {
+		return nil, fmt.Errorf("at least one pub_allow or sub_allow subject is required")
+	}
+	for _, s := range append(append([]string(nil), req.PubAllow...), req.SubAllow...) {
+		if s == "" || strings.ContainsAny(s, " \t\r\n") {
+			return nil, fmt.Errorf("invalid subject %q", s)
+		}
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return nil, fmt.Errorf("reason is required")
+	}
+	if approver == nil || approver.Subject == "" {
+		return nil, fmt.Errorf("approver is required")
+	}
+	if approver.Issuer == req.Issuer && approver.Subject == req.Subject {
+		return nil, fmt.Errorf("a grant cannot be approved by its own subject")
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration %q: %w", req.Duration, err)
+	}
+	if d <= 0 || d > maxDuration {
+		return nil, fmt.Errorf("duration must be between 0 and %s", maxDuration)
+	}
+	return &Grant{
+		ID:        nuid.Next(),
+		Issuer:    req.Issuer,
+		Subject:   req.Subject,
+		PubAllow:  req.PubAllow,
+		SubAllow:  req.SubAllow,
+		Reason:    req.Reason,
+		Approver:  approver.Subject,
+		CreatedAt: now,
+		ExpiresAt: now.Add(d),
+	}, nil
+}
+
+// Add stores a grant.
+func (s *GrantStore) Add(g *Grant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grants[g.ID] = g
+}
+
+// Active returns the unexpired grants for an identity. A nil store has none.
+func (s *GrantStore) Active(issuer, subject string, now time.Time) []*Grant {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*Grant
+	for _, g := range s.grants {
+		if g.Issuer == issuer && g.Subject == subject && now.Before(g.ExpiresAt) {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// List returns all stored grants ordered by expiry.
+func (s *GrantStore) List() []*Grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*Grant, 0, len(s.grants))
+	for _, g := range s.grants {
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ExpiresAt.Before(out[j].ExpiresAt) })
+	return out
+}
+
+// WatchKV mirrors a NATS KV bucket into the store. Keys are grant IDs;
+// values are JSON grants. It returns once the initial contents have been
+// loaded and keeps applying updates in the background until ctx is
+// cancelled.
+func (s *GrantStore) WatchKV(ctx context.Context, kv nats.KeyValue) error {
+	apply := func(entry nats.KeyValueEntry) {
+		switch entry.Operation() {
+		case nats.KeyValueDelete, nats.KeyValuePurge:
+			s.Revoke(entry.Key())
+		default:
+			var g Grant
+			if err := json.Unmarshal(entry.Value(), &g); err != nil {
+				log.Printf("Ignoring invalid grant %s: %v", entry.Key(), err)
+				return
+			}
+			s.Add(&g)
+		}
+	}
+
+	if err := watchKV(ctx, kv, apply); err != nil {
+		return fmt.Errorf("failed to watch grants bucket %s: %w", kv.Bucket(), err)
+	}
+	return nil
+}
+
+// Revoke removes a grant, returning it or nil when it does not exist.
+func (s *GrantStore) Revoke(id string) *Grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.grants[id]
+	delete(s.grants, id)
+	return g
+}
+
+// Sweep removes and returns the grants that have expired at now.
+func (s *GrantStore) Sweep(now time.Time) []*Grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []*Grant
+	for id, g := range s.grants {
+		if !now.Before(g.ExpiresAt) {
+			expired = append(expired, g)
+			delete(s.grants, id)
+		}
+	}
+	return expired
+}
+
+// GrantAdminConfig configures the grant admin API.
+type GrantAdminConfig struct {
+	MaxDuration   time.Duration
+	ApproverScope string        // defaults to DefaultGrantApproverScope
+	SweepInterval time.Duration // defaults to 10s
+}
+
+// approverClaims validates an approver's token, which must carry scope and
+// must not be on the revocation list.
+func approverClaims(ctx context.Context, verifiers *VerifierSet, revocations *RevocationList, token, scope string) (*OIDCClaims, error) {
+	if token == "" {
+		return nil, fmt.Errorf("approver_token is required")
+	}
+	claims, issuer, err := ValidateToken(ctx, token, verifiers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid approver token: %w", err)
+	}
+	if r := revocations.Check(issuer, claims); r != nil {
+		return nil, fmt.Errorf("approver token revoked (%s)", r.Kind)
+	}
+	if !slices.Contains(claims.Scopes, scope) {
+		return nil, fmt.Errorf("approver %s lacks scope %s", claims.Subject, scope)
+	}
+	return claims, nil
+}
+
+// claimExpiry deletes an expired grant or revocation from kv unless it
+// changed or another replica deleted it first, so each expiry is reported
+// once.
+func claimExpiry(kv nats.KeyValue, id string) bool {
+	entry, err := kv.Get(id)
+	if err != nil {
+		return false
+	}
+	return kv.Delete(id, nats.LastRevision(entry.Revision())) == nil
+}
+
+// ServeGrantAdmin subscribes to the grant admin subjects and expires grants
+// in the background until ctx is cancelled. Grants are written to kv, which
+// every replica watches, and applied to store immediately so the serving
+// replica merges them without waiting for the watch. Approvers authenticate
+// with their own token, validated by verifiers and checked against
+// revocations, both to create and to revoke grants.
+func ServeGrantAdmin(ctx context.Context, nc *nats.Conn, kv nats.KeyValue, store *GrantStore, verifiers *VerifierSet, revocations *RevocationList, audit *AuditPublisher, cfg GrantAdminConfig) error {
+	if cfg.ApproverScope == "" {
+		cfg.ApproverScope = DefaultGrantApproverScope
+	}
+	if cfg.SweepInterval == 0 {
+		cfg.SweepInterval = 10 * time.Second
+	}
+	respond := func(msg *nats.Msg, resp GrantResponse) {
+		data, _ := json.Marshal(resp)
+		if err := msg.Respond(data); err != nil {
+			log.Printf("Failed to respond to %s: %v", msg.Subject, err)
+		}
+	}
+
+	handlers := map[string]nats.MsgHandler{
+		GrantCreateSubject: func(msg *nats.Msg) {
+			var req GrantRequest
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				respond(msg, GrantResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+				return
+			}
+			reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			approver, err := approverClaims(reqCtx, verifiers, revocations, req.ApproverToken, cfg.ApproverScope)
+			if err != nil {
+				respond(msg, GrantResponse{Error: err.Error()})
+				return
+			}
+			g, err := NewGrant(req, approver, time.Now().UTC(), cfg.MaxDuration)
+			if err != nil {
+				respond(msg, GrantResponse{Error: err.Error()})
+				return
+			}
+			data, _ := json.Marshal(g)
+			if _, err := kv.Create(g.ID, data); err != nil {
+				respond(msg, GrantResponse{Error: fmt.Sprintf("failed to store grant: %v", err)})
+				return
+			}
+			store.Add(g)
+			log.Printf("Created grant %s for sub=%s until %s (approver=%s reason=%q)", g.ID, g.Subject, g.ExpiresAt, g.Approver, g.Reason)
+			audit.PublishGrant("created", g)
+			respond(msg, GrantResponse{Grant: g})
+		},
+		GrantListSubject: func(msg *nats.Msg) {
+			respond(msg, GrantResponse{Grants: store.List()})
+		},
+		GrantRevokeSubject: func(msg *nats.Msg) {
+			var req GrantRevokeRequest
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				respond(msg, GrantResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+				return
+			}
+			reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			approver, err := approverClaims(reqCtx, verifiers, revocations, req.ApproverToken, cfg.ApproverScope)
+			if err != nil {
+				respond(msg, GrantResponse{Error: err.Error()})
+				return
+			}
+			entry, err := kv.Get(req.ID)
+			if err != nil {
+				respond(msg, GrantResponse{Error: fmt.Sprintf("grant %s not found", req.ID)})
+				return
+			}
+			var g Grant
+			if err := json.Unmarshal(entry.Value(), &g); err != nil {
+				respond(msg, GrantResponse{Error: fmt.Sprintf("invalid stored grant %s: %v", req.ID, err)})
+				return
+			}
+			if err := kv.Delete(req.ID, nats.LastRevision(entry.Revision())); err != nil {
+				respond(msg, GrantResponse{Error: fmt.Sprintf("failed to revoke grant: %v", err)})
+				return
+			}
+			store.Revoke(req.ID)
+			g.RevokedBy = approver.Subject
+			log.Printf("Revoked grant %s for sub=%s (by %s)", g.ID, g.Subject, g.RevokedBy)
+			audit.PublishGrant("revoked", &g)
+			respond(msg, GrantResponse{Grant: &g})
+		},
+	}
+	for subject, handler := range handlers {
+		sub, err := nc.QueueSubscribe(subject, adminQueue, handler)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+		}
+		go func() {
+			<-ctx.Done()
+			sub.Unsubscribe()
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(cfg.SweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, g := range store.Sweep(now) {
+					if !claimExpiry(kv, g.ID) {
+						continue
+					}
+					log.Printf("Grant %s for sub=%s expired", g.ID, g.Subject)
+					audit.PublishGrant("expired", g)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+var testApprover = &OIDCClaims{Issuer: testIssuer, Subject: "bob"}
+
+func validGrantRequest() GrantRequest {
+	return GrantRequest{
+		Issuer:   testIssuer,
+		Subject:  "oncall-alice",
+		PubAllow: []string{"orders.>"},
+		Duration: "1h",
+		Reason:   "INC-1234 replay stuck orders",
+	}
+}
+
+func TestNewGrant_Validation(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	g, err := NewGrant(validGrantRequest(), testApprover, now, 8*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if g.ID == "" || g.Approver != "bob" || !g.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("unexpected grant %+v", g)
+	}
+
+	invalid := map[string]func(*GrantRequest, **OIDCClaims){
+		"no reason":       func(r *GrantRequest, _ **OIDCClaims) { r.Reason = " " },
+		"no approver":     func(_ *GrantRequest, a **OIDCClaims) { *a = nil },
+		"self approval":   func(r *GrantRequest, a **OIDCClaims) { *a = &OIDCClaims{Issuer: r.Issuer, Subject: r.Subject} },
+		"no subjects":     func(r *GrantRequest, _ **OIDCClaims) { r.PubAllow = nil },
+		"too long":        func(r *GrantRequest, _ **OIDCClaims) { r.Duration = "24h" },
+		"bad duration":    func(r *GrantRequest, _ **OIDCClaims) { r.Duration = "soon" },
+		"missing subject": func(r *GrantRequest, _ **OIDCClaims) { r.Subject = "" },
+	}
+	for name, mutate := range invalid {
+		req, approver := validGrantRequest(), testApprover
+		mutate(&req, &approver)
+		if _, err := NewGrant(req, approver, now, 8*time.Hour); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	// The same subject at another issuer is a different identity.
+	if _, err := NewGrant(validGrantRequest(), &OIDCClaims{Issuer: "https://other.example.com", Subject: "oncall-alice"}, now, 8*time.Hour); err != nil {
+		t.Errorf("unexpected error for approver of another issuer: %v", err)
+	}
+}
+
+func TestGrantStore_ActiveAndSweep(t *testing.T) {
+	now := time.Now()
+	store := NewGrantStore()
+	g, _ := NewGrant(validGrantRequest(), testApprover, now, 8*time.Hour)
+	store.Add(g)
+
+	if active := store.Active(testIssuer, "oncall-alice", now); len(active) != 1 {
+		t.Fatalf("expected one active grant, got %v", active)
+	}
+	if active := store.Active(testIssuer, "oncall-bob", now); len(active) != 0 {
+		t.Errorf("expected no grants for another identity, got %v", active)
+	}
+	if active := store.Active(testIssuer, "oncall-alice", now.Add(2*time.Hour)); len(active) != 0 {
+		t.Errorf("expected expired grant to be inactive, got %v", active)
+	}
+
+	if expired := store.Sweep(now); len(expired) != 0 {
+		t.Errorf("expected nothing to expire yet, got %v", expired)
+	}
+	if expired := store.Sweep(now.Add(2 * time.Hour)); len(expired) != 1 || expired[0].ID != g.ID {
+		t.Errorf("expected grant to expire, got %v", expired)
+	}
+	if len(store.List()) != 0 {
+		t.Error("expected store to be empty after sweep")
+	}
+}
+
+func TestEvaluate_GrantMergedAndCapsExpiry(t *testing.T) {
+	now := time.Now()
+	short, _ := NewGrant(validGrantRequest(), testApprover, now, 8*time.Hour)
+	longReq := validGrantRequest()
+	longReq.Duration = "4h"
+	longReq.PubAllow = []string{"$SYS.REQ.>"}
+	long, _ := NewGrant(longReq, testApprover, now, 8*time.Hour)
+
+	claims := &OIDCClaims{Issuer: testIssuer, Subject: "oncall-alice", Scopes: []string{"nats:subscribe"}}
+	d := DefaultPolicy().Evaluate(claims, nil, []*Grant{long, short})
+	if !d.Allowed {
+		t.Fatalf("expected allowed decision, got %+v", d)
+	}
+	if !slices.Contains(d.Permissions.PubAllow, "orders.>") {
+		t.Errorf("expected grant pub allow, got %v", d.Permissions.PubAllow)
+	}
+	if !slices.Contains(d.Permissions.PubDeny, "$SYS.>") {
+		t.Errorf("expected guardrails to still apply to grants, got %v", d.Permissions.PubDeny)
+	}
+	if !d.Expires.Equal(short.ExpiresAt) {
+		t.Errorf("expected expiry capped at earliest grant end %s, got %s", short.ExpiresAt, d.Expires)
+	}
+	if len(d.Grants) != 2 {
+		t.Errorf("expected both grants recorded, got %v", d.Grants)
+	}
+}
+
+func TestServeGrantAdmin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nc, js := runJetStream(t)
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "auth-grants"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := newFakeIssuer(t, "https://login.example.com")
+	verifiers := NewVerifierSet(iss.verifier())
+	revocations := NewRevocationList()
+	revocations.put(RevocationKey(iss.url, RevokeSubject, "mallory"), &Revocation{
+		Issuer: iss.url, Kind: RevokeSubject, Value: "mallory", NotBefore: time.Now().Add(time.Hour),
+	})
+	audits, err := nc.SubscribeSync("auth.audit.grant.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two replicas sharing the bucket, both serving the admin API.
+	replicas := []*GrantStore{NewGrantStore(), NewGrantStore()}
+	for _, store := range replicas {
+		if err := store.WatchKV(ctx, kv); err != nil {
+			t.Fatal(err)
+		}
+		cfg := GrantAdminConfig{MaxDuration: time.Hour, SweepInterval: 20 * time.Millisecond}
+		if err := ServeGrantAdmin(ctx, nc, kv, store, verifiers, revocations, NewAuditPublisher(nc), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request := func(subject string, req any) GrantResponse {
+		t.Helper()
+		msg, err := nc.Request(subject, mustMarshal(t, req), 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp GrantResponse
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	create := func(approverToken, duration string) GrantResponse {
+		t.Helper()
+		req := validGrantRequest()
+		req.Issuer = iss.url
+		req.Duration = duration
+		req.ApproverToken = approverToken
+		return request(GrantCreateSubject, req)
+	}
+	active := func(store *GrantStore) int {
+		return len(store.Active(iss.url, "oncall-alice", time.Now()))
+	}
+
+	for name, token := range map[string]string{
+		"no token":      "",
+		"invalid token": "not-a-token",
+		"missing scope": iss.sign(t, "bob", "nats:admin", time.Hour, nil),
+		"self approval": iss.sign(t, "oncall-alice", DefaultGrantApproverScope, time.Hour, nil),
+		"revoked":       iss.sign(t, "mallory", DefaultGrantApproverScope, time.Hour, nil),
+	} {
+		if resp := create(token, "1h"); resp.Error == "" {
+			t.Errorf("%s: expected the grant to be refused", name)
+		}
+	}
+
+	approverToken := iss.sign(t, "bob", "nats:subscribe "+DefaultGrantApproverScope, time.Hour, nil)
+	resp := create(approverToken, "1h")
+	if resp.Error != "" || resp.Grant.Approver != "bob" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	waitFor(t, "grant to reach both replicas", func() bool { return active(replicas[0]) == 1 && active(replicas[1]) == 1 })
+
+	for name, token := range map[string]string{
+		"no token":      "",
+		"missing scope": iss.sign(t, "bob", "nats:admin", time.Hour, nil),
+		"revoked":       iss.sign(t, "mallory", DefaultGrantApproverScope, time.Hour, nil),
+	} {
+		if resp := request(GrantRevokeSubject, GrantRevokeRequest{ID: resp.Grant.ID, ApproverToken: token}); resp.Error == "" {
+			t.Errorf("%s: expected the revocation to be refused", name)
+		}
+	}
+	if active(replicas[0]) != 1 {
+		t.Fatal("expected refused revocations to keep the grant")
+	}
+	if resp := request(GrantRevokeSubject, GrantRevokeRequest{ID: resp.Grant.ID, ApproverToken: approverToken}); resp.Error != "" || resp.Grant.RevokedBy != "bob" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	waitFor(t, "revocation to reach both replicas", func() bool { return active(replicas[0]) == 0 && active(replicas[1]) == 0 })
+	if resp := request(GrantRevokeSubject, GrantRevokeRequest{ID: resp.Grant.ID, ApproverToken: approverToken}); !strings.Contains(resp.Error, "not found") {
+		t.Errorf("expected revoking a removed grant to fail, got %+v", resp)
+	}
+
+	// Both replicas sweep the expired grant; only one reports it.
+	expiring := create(approverToken, "50ms")
+	if expiring.Error != "" {
+		t.Fatalf("unexpected error: %s", expiring.Error)
+	}
+	for _, subject := range []string{"created", "revoked", "created", "expired"} {
+		msg, err := audits.NextMsg(2 * time.Second)
+		if err != nil || msg.Subject != "auth.audit.grant."+subject {
+			t.Fatalf("expected %s audit event, got %v %v", subject, msg, err)
+		}
+	}
+	if msg, err := audits.NextMsg(200 * time.Millisecond); err == nil {
+		t.Errorf("expected one audit event per action, got extra %s", msg.Subject)
+	}
+	if _, err := kv.Get(expiring.Grant.ID); err == nil {
+		t.Error("expected the expired grant to be deleted from the bucket")
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nats-io/nats-server/v2/conf"
+)
+
+// globalAccount is the account nats-server places users in when they are
+// declared under the top-level authorization block.
+const globalAccount = "$G"
+
+// ImportResult is a policy converted from a nats-server configuration,
+// together with the scope suggested for each static user and the constructs
+// that could not be carried over.
+type ImportResult struct {
+	Policy *Policy         `json:"policy"`
+	Users  []*ImportedUser `json:"users"`
+	Issues []ImportIssue   `json:"issues,omitempty"`
+}
+
+// ImportedUser maps a static user to the scope that replaces it. Granting
+// the scope to the user's IdP client reproduces its permissions.
+type ImportedUser struct {
+	Name    string `json:"name"`
+	Account string `json:"account"`
+	Scope   string `json:"scope"`
+}
+
+// ImportIssue describes a construct that was dropped or changed on import.
+type ImportIssue struct {
+	Location string `json:"location"`
+	Message  string `json:"message"`
+}
+
+// staticUser is a user entry read from the server config.
+type staticUser struct {
+	location string
+	account  string
+	entry    map[string]any
+	defaults map[string]any
+}
+
+// ImportServerConfig converts the static users of one account in a parsed
+// nats-server configuration into a policy with one scope per user, named
+// "<scopePrefix>:<user>". An empty account selects the only account that
+// declares users. Users of other accounts are reported, not converted.
+func ImportServerConfig(cfg map[string]any, account, scopePrefix string) (*ImportResult, error) {
+	if scopePrefix == "" || strings.ContainsAny(scopePrefix, ": \t") {
+		return nil, fmt.Errorf("invalid scope prefix %q", scopePrefix)
+	}
+	result := &ImportResult{}
+	users, callout := collectStaticUsers(cfg, result)
+
+	if account == "" {
+		accounts := map[string]bool{}
+		for _, u := range users {
+			if !callout[u.name()] {
+				accounts[u.account] = true
+			}
+		}
+		if len(accounts) > 1 {
+			return nil, fmt.Errorf("users are declared in several accounts (%s); select one with -account", strings.Join(sortedKeys(accounts), ", "))
+		}
+		if len(accounts) == 0 {
+			return nil, fmt.Errorf("config declares no static users besides auth_callout users")
+		}
+		for a := range accounts {
+			account = a
+		}
+	}
+
+	policy := &Policy{Scopes: map[string]ScopeMapping{}, Account: account}
+	if account == globalAccount {
+		policy.Account = DefaultAccount
+		result.addIssue("authorization.users", "users were in the global account; the policy places them in account %s", DefaultAccount)
+	}
+
+	for _, u := range users {
+		name := u.name()
+		switch {
+		case name == "":
+			result.addIssue(u.location, "user has neither user nor nkey; skipped")
+			continue
+		case callout[name]:
+			result.addIssue(u.location, "user %s is an auth_callout auth_user and must stay in the server config; skipped", name)
+			continue
+		case u.account != account:
+			result.addIssue(u.location, "user %s belongs to account %s; skipped", name, u.account)
+			continue
+		}
+		scope := scopePrefix + ":" + name
+		if _, dup := policy.Scopes[scope]; dup {
+			result.addIssue(u.location, "duplicate user %s; skipped", name)
+			continue
+		}
+		policy.Scopes[scope] = u.mapping(result)
+		result.Users = append(result.Users, &ImportedUser{Name: name, Account: policy.Account, Scope: scope})
+	}
+	if len(policy.Scopes) == 0 {
+		return nil, fmt.Errorf("no users to convert in account %q", account)
+	}
+	result.Policy = policy
+	return result, nil
+}
+
+// collectStaticUsers walks the authorization and accounts blocks, returning
+// their users in config order and the names of auth callout service users.
+func collectStaticUsers(cfg map[string]any, result *ImportResult) ([]*staticUser, map[string]bool) {
+	var users []*staticUser
+	callout := map[string]bool{}
+
+	if auth, ok := cfg["authorization"].(map[string]any); ok {
+		defaults, _ := auth["default_permissions"].(map[string]any)
+		for _, key := range sortedKeys(auth) {
+			switch key {
+			case "users", "default_permissions", "timeout":
+			case "user", "password", "permissions":
+				// Single-user authorization is converted like a users entry
+			case "auth_callout":
+				if c, ok := auth[key].(map[string]any); ok {
+					for _, name := range stringList(c["auth_users"]) {
+						callout[name] = true
+					}
+				}
+			default:
+				result.addIssue("authorization."+key, "not supported by the policy format")
+			}
+		}
+		if name, ok := auth["user"].(string); ok {
+			entry := map[string]any{"user": name, "password": auth["password"]}
+			if perms, ok := auth["permissions"]; ok {
+				entry["permissions"] = perms
+			}
+			users = append(users, &staticUser{location: "authorization", account: globalAccount, entry: entry, defaults: defaults})
+		}
+		users = append(users, userEntries("authorization.users", globalAccount, auth["users"], defaults, result)...)
+	}
+
+	if accounts, ok := cfg["accounts"].(map[string]any); ok {
+		for _, name := range sortedKeys(accounts) {
+			acc, ok := accounts[name].(map[string]any)
+			if !ok {
+				continue
+			}
+			location := "accounts." + name
+			defaults, _ := acc["default_permissions"].(map[string]any)
+			for _, key := range sortedKeys(acc) {
+				switch key {
+				case "users", "default_permissions":
+				default:
+					result.addIssue(location+"."+key, "account settings are not part of the policy; configure them on the server")
+				}
+			}
+			users = append(users, userEntries(location+".users", name, acc["users"], defaults, result)...)
+		}
+	}
+	return users, callout
+}
+
+func userEntries(location, account string, v any, defaults map[string]any, result *ImportResult) []*staticUser {
+	list, ok := v.([]any)
+	if v != nil && !ok {
+		result.addIssue(location, "expected a list of users")
+		return nil
+	}
+	var users []*staticUser
+	for i, item := range list {
+		entry, ok := item.(map[string]any)
+		at := fmt.Sprintf("%s[%d]", location, i)
+		if !ok {
+			result.addIssue(at, "expected a user map")
+			continue
+		}
+		users = append(users, &staticUser{location: at, account: account, entry: entry, defaults: defaults})
+	}
+	return users
+}
+
+func (u *staticUser) name() string {
+	if name, ok := u.entry["user"].(string); ok {
+		return name
+	}
+	name, _ := u.entry["nkey"].(string)
+	return name
+}
+
+// mapping converts the user's permissions, or the account defaults when it
+// has none, into a scope mapping.
+func (u *staticUser) mapping(result *ImportResult) ScopeMapping {
+	for _, key := range sortedKeys(u.entry) {
+		switch key {
+		case "user", "nkey", "password", "permissions":
+		default:
+			result.addIssue(u.location+"."+key, "user setting not supported by the policy format")
+		}
+	}
+
+	perms, ok := u.entry["permissions"].(map[string]any)
+	if !ok {
+		perms = u.defaults
+	}
+	if perms == nil {
+		result.addIssue(u.location, "user %s has no permissions and was unrestricted; converted to full access, which guardrails still limit", u.name())
+		return ScopeMapping{PubAllow: []string{">"}, SubAllow: []string{">"}}
+	}
+
+	var m ScopeMapping
+	for _, key := range sortedKeys(perms) {
+		at := u.location + ".permissions." + key
+		switch key {
+		case "publish", "pub":
+			allow, deny := subjectPermission(at, perms[key], result)
+			m.PubAllow = append(m.PubAllow, allow...)
+			m.PubDeny = append(m.PubDeny, deny...)
+		case "subscribe", "sub":
+			allow, deny := subjectPermission(at, perms[key], result)
+			m.SubAllow = append(m.SubAllow, dropQueueSubjects(at, allow, result)...)
+			m.SubDeny = append(m.SubDeny, dropQueueSubjects(at, deny, result)...)
+		case "allow_responses", "responses":
+			result.addIssue(at, "response permissions are set by the callout service for every user")
+		default:
+			result.addIssue(at, "permission not supported by the policy format")
+		}
+	}
+	// nats-server leaves a direction without permissions unrestricted
+	if _, ok := perms["publish"]; !ok && perms["pub"] == nil {
+		m.PubAllow = []string{">"}
+	}
+	if _, ok := perms["subscribe"]; !ok && perms["sub"] == nil {
+		m.SubAllow = []string{">"}
+	}
+	return m
+}
+
+// subjectPermission reads a publish or subscribe permission, which is either
+// a subject list (allow only) or a map with allow and deny lists. A map with
+// only a deny list allows everything else.
+func subjectPermission(location string, v any, result *ImportResult) (allow, deny []string) {
+	if m, ok := v.(map[string]any); ok {
+		for _, key := range sortedKeys(m) {
+			if key != "allow" && key != "deny" {
+				result.addIssue(location+"."+key, "permission not supported by the policy format")
+			}
+		}
+		allow, deny = stringList(m["allow"]), stringList(m["deny"])
+		if m["allow"] == nil && len(deny) > 0 {
+			allow = []string{">"}
+		}
+		return allow, deny
+	}
+	return stringList(v), nil
+}
+
+// dropQueueSubjects removes queue-group permissions ("subject queue"), which
+// the policy format cannot express.
+func dropQueueSubjects(location string, subjects []string, result *ImportResult) []string {
+	out := subjects[:0]
+	for _, s := range subjects {
+		if strings.ContainsAny(s, " \t") {
+			result.addIssue(location, "queue group permission %q not converted", s)
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *ImportResult) addIssue(location, format string, args ...any) {
+	r.Issues = append(r.Issues, ImportIssue{Location: location, Message: fmt.Sprintf(format, args...)})
+}
+
+// runImportConfig implements the "import-config" command.
+func runImportConfig(args []string) int {
+	fs := flag.NewFlagSet("import-config", flag.ContinueOnError)
+	configFile := fs.String("config", "", "nats-server configuration file (required)")
+	account := fs.String("account", "", "Account whose users are converted; required when several accounts declare users")
+	scopePrefix := fs.String("scope-prefix", "legacy", "Prefix of the generated scope names")
+	out := fs.String("out", "-", "Policy output file; \"-\" writes stdout")
+	format := fs.String("format", "text", "Report format on stderr: text|json")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: auth-service import-config -config <file> [-account <name>] [-out <file>]")
+		fmt.Fprintln(fs.Output(), "Converts static nats-server users into a policy with one scope per user.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *configFile == "" {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := conf.ParseFile(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse server config: %v\n", err)
+		return 1
+	}
+	result, err := ImportServerConfig(cfg, *account, *scopePrefix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	data, err := json.MarshalIndent(result.Policy, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data = append(data, '\n')
+	if *out == "-" {
+		os.Stdout.Write(data)
+	} else if err := os.WriteFile(*out, data, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write policy: %v\n", err)
+		return 1
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stderr)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			Users  []*ImportedUser `json:"users"`
+			Issues []ImportIssue   `json:"issues"`
+		}{result.Users, result.Issues}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "text":
+		writeImportText(os.Stderr, result)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+	return 0
+}
+
+func writeImportText(w io.Writer, result *ImportResult) {
+	fmt.Fprintf(w, "Converted %d users into account %s. Grant each scope to the client replacing the user:\n\n",
+		len(result.Users), result.Policy.Account)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tSCOPE")
+	for _, u := range result.Users {
+		fmt.Fprintf(tw, "%s\t%s\n", u.Name, u.Scope)
+	}
+	tw.Flush()
+
+	if len(result.Issues) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nNot converted (%d):\n\n", len(result.Issues))
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, issue := range result.Issues {
+		fmt.Fprintf(tw, "%s\t%s\n", issue.Location, issue.Message)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/conf"
+)
+
+const testServerConfig = `
+accounts {
+  AUTH: {
+    users: [ { user: "auth-service", password: "secret" } ]
+  }
+  APP: {
+    jetstream: enabled
+    default_permissions: { publish: "events.>", subscribe: "_INBOX.>" }
+    users: [
+      { user: "orders", password: "x", permissions: {
+          publish: { allow: ["orders.>"], deny: ["orders.admin.>"] }
+          subscribe: ["orders.>", "work.* workers"]
+          allow_responses: true
+      } }
+      { nkey: "UDXU4RCSJNZOIQHZNWXHXORDPRTGNJAHAHFRGZNEEJCPQTT2M7NLCNF4" }
+      { user: "ops" }
+    ]
+  }
+}
+authorization {
+  auth_callout { issuer: "AABC", account: AUTH, auth_users: ["auth-service"] }
+}
+`
+
+func TestImportServerConfig(t *testing.T) {
+	cfg, err := conf.Parse(testServerConfig)
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	result, err := ImportServerConfig(cfg, "APP", "legacy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Policy.Account != "APP" || len(result.Users) != 3 {
+		t.Fatalf("expected 3 users in APP, got %d in %s", len(result.Users), result.Policy.Account)
+	}
+	orders := result.Policy.Scopes["legacy:orders"]
+	expected := ScopeMapping{
+		PubAllow: []string{"orders.>"},
+		PubDeny:  []string{"orders.admin.>"},
+		SubAllow: []string{"orders.>"},
+	}
+	if !reflect.DeepEqual(orders, expected) {
+		t.Errorf("expected %+v, got %+v", expected, orders)
+	}
+	nkey := result.Policy.Scopes["legacy:UDXU4RCSJNZOIQHZNWXHXORDPRTGNJAHAHFRGZNEEJCPQTT2M7NLCNF4"]
+	if !reflect.DeepEqual(nkey.PubAllow, []string{"events.>"}) || !reflect.DeepEqual(nkey.SubAllow, []string{"_INBOX.>"}) {
+		t.Errorf("expected account default permissions for nkey user, got %+v", nkey)
+	}
+
+	report := issueText(result)
+	for _, want := range []string{"work.* workers", "allow_responses", "accounts.APP.jetstream", "auth_callout auth_user"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("expected report to mention %q, got:\n%s", want, report)
+		}
+	}
+
+	// The converted policy must load as a regular policy file
+	if _, err := ParsePolicy(mustMarshal(t, result.Policy)); err != nil {
+		t.Errorf("converted policy does not parse: %v", err)
+	}
+}
+
+func TestImportServerConfig_GlobalUnrestricted(t *testing.T) {
+	cfg, err := conf.Parse(`authorization { users: [ { user: "root", password: "x" } ] }`)
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	result, err := ImportServerConfig(cfg, "", "legacy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Policy.Account != DefaultAccount {
+		t.Errorf("expected global users to move to %s, got %s", DefaultAccount, result.Policy.Account)
+	}
+	root := result.Policy.Scopes["legacy:root"]
+	if !reflect.DeepEqual(root.PubAllow, []string{">"}) || !reflect.DeepEqual(root.SubAllow, []string{">"}) {
+		t.Errorf("expected unrestricted user to get full access, got %+v", root)
+	}
+	if !strings.Contains(issueText(result), "unrestricted") {
+		t.Errorf("expected unrestricted user to be reported, got:\n%s", issueText(result))
+	}
+}
+
+func TestImportServerConfig_ImplicitAllow(t *testing.T) {
+	cfg, err := conf.Parse(`accounts { APP: { users: [
+	  { user: "pub", permissions: { publish: { deny: "secret.>" } } }
+	] } }`)
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	result, err := ImportServerConfig(cfg, "", "legacy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := ScopeMapping{
+		PubAllow: []string{">"},
+		PubDeny:  []string{"secret.>"},
+		SubAllow: []string{">"},
+	}
+	if got := result.Policy.Scopes["legacy:pub"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected deny-only and missing directions to allow everything else %+v, got %+v", expected, got)
+	}
+}
+
+func TestImportServerConfig_AmbiguousAccount(t *testing.T) {
+	cfg, err := conf.Parse(`accounts { A: { users: [ { user: "a" } ] }, B: { users: [ { user: "b" } ] } }`)
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	if _, err := ImportServerConfig(cfg, "", "legacy"); err == nil {
+		t.Error("expected an error when users span several accounts")
+	}
+}
+
+func issueText(result *ImportResult) string {
+	var b strings.Builder
+	for _, issue := range result.Issues {
+		b.WriteString(issue.Location + ": " + issue.Message + "\n")
+	}
+	return b.String()
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return data
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// sharedInbox is the subscribe grant that exposes every client's replies.
+const sharedInbox = "_INBOX.>"
+
+// InboxPrefix returns the private reply-inbox prefix for an identity. It is
+// derived from the token's issuer and subject so clients can compute it
+// themselves (see demo-client/inbox.go) and pass it to nats.CustomInboxPrefix.
+func InboxPrefix(issuer, subject string) string {
+	sum := sha256.Sum256([]byte(issuer + "\x00" + subject))
+	return "_INBOX." + hex.EncodeToString(sum[:16])
+}
+
+// NarrowInboxes replaces a shared "_INBOX.>" subscribe grant with the given
+// private inbox prefix.
+func (p *ResolvedPermissions) NarrowInboxes(prefix string) {
+	for i, s := range p.SubAllow {
+		if s == sharedInbox {
+			p.SubAllow[i] = prefix + ".>"
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// IntrospectionVerifier verifies tokens, including opaque reference tokens,
+// by asking the issuer's RFC 7662 introspection endpoint. The issuer's
+// audience and time settings are applied to the introspection response.
+type IntrospectionVerifier struct {
+	config       IssuerConfig
+	endpoint     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+}
+
+// introspectionResponse is the subset of an RFC 7662 response the service uses.
+type introspectionResponse struct {
+	Active    bool         `json:"active"`
+	Scope     string       `json:"scope"`
+	Subject   string       `json:"sub"`
+	ClientID  string       `json:"client_id"`
+	JWTID     string       `json:"jti"`
+	ACR       string       `json:"acr"`
+	AMR       []string     `json:"amr"`
+	Issuer    string       `json:"iss"`
+	Audience  audience     `json:"aud"`
+	Expiry    *numericDate `json:"exp"`
+	NotBefore *numericDate `json:"nbf"`
+	IssuedAt  *numericDate `json:"iat"`
+}
+
+// NewIntrospectionVerifier builds an introspection verifier. The endpoint is
+// taken from the introspection_endpoint in the provider metadata unless
+// cfg.IntrospectionURL is set, in which case no discovery is made.
+func NewIntrospectionVerifier(ctx context.Context, cfg IssuerConfig) (*IntrospectionVerifier, error) {
+	secret := os.Getenv(cfg.ClientSecretEnv)
+	if cfg.ClientID == "" || secret == "" {
+		return nil, fmt.Errorf("issuer %s: introspection requires client_id and a secret in client_secret_env", cfg.URL)
+	}
+
+	endpoint := cfg.IntrospectionURL
+	if endpoint == "" {
+		provider, err := oidc.NewProvider(ctx, cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover OIDC provider at %s: %w", cfg.URL, err)
+		}
+		var metadata struct {
+			IntrospectionEndpoint string `json:"introspection_endpoint"`
+		}
+		if err := provider.Claims(&metadata); err != nil {
+			return nil, fmt.Errorf("failed to parse provider metadata of %s: %w", cfg.URL, err)
+		}
+		if metadata.IntrospectionEndpoint == "" {
+			return nil, fmt.Errorf("provider %s advertises no introspection_endpoint", cfg.URL)
+		}
+		endpoint = metadata.IntrospectionEndpoint
+	}
+
+	return &IntrospectionVerifier{
+		config:       cfg,
+		endpoint:     endpoint,
+		clientID:     cfg.ClientID,
+		clientSecret: secret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Config returns the issuer configuration the verifier applies.
+func (v *IntrospectionVerifier) Config() IssuerConfig { return v.config }
+
+// Verify introspects the token and extracts claims from an active response.
+func (v *IntrospectionVerifier) Verify(ctx context.Context, rawToken string) (*OIDCClaims, error) {
+	form := url.Values{"token": {rawToken}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIntrospection, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// RFC 6749 section 2.3.1: credentials are form-encoded before basic auth.
+	req.SetBasicAuth(url.QueryEscape(v.clientID), url.QueryEscape(v.clientSecret))
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIntrospection, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: endpoint returned %s", ErrIntrospection, resp.Status)
+	}
+	var r introspectionResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&r); err != nil {
+		return nil, fmt.Errorf("%w: invalid response: %v", ErrIntrospection, err)
+	}
+
+	if !r.Active {
+		return nil, ErrTokenInactive
+	}
+	if r.Issuer != "" && r.Issuer != v.config.URL {
+		return nil, fmt.Errorf("%w: response names issuer %q", ErrIntrospection, r.Issuer)
+	}
+	tok := &unverifiedToken{
+		Issuer:    v.config.URL,
+		Audience:  r.Audience,
+		Expiry:    r.Expiry,
+		NotBefore: r.NotBefore,
+		IssuedAt:  r.IssuedAt,
+	}
+	if err := checkClaims(v.config, tok, time.Now()); err != nil {
+		return nil, err
+	}
+
+	claims := &OIDCClaims{
+		Issuer:   v.config.URL,
+		Subject:  r.Subject,
+		Scope:    r.Scope,
+		ClientID: r.ClientID,
+		JWTID:    r.JWTID,
+		ACR:      r.ACR,
+		AMR:      r.AMR,
+		Expiry:   r.Expiry.Time(),
+	}
+	if r.IssuedAt != nil {
+		claims.IssuedAt = r.IssuedAt.Time()
+	}
+	claims.normalize()
+	return claims, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newIntrospectionServer stands in for an introspection endpoint that
+// answers with responses[token], or active=false for unknown tokens.
+func newIntrospectionServer(t *testing.T, responses map[string]map[string]any) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		secret, _ = url.QueryUnescape(secret)
+		if id != "nats-auth" || secret != "s3cret%" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost || r.PostFormValue("token_type_hint") != "access_token" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		resp, ok := responses[r.PostFormValue("token")]
+		if !ok {
+			resp = map[string]any{"active": false}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestIntrospectionVerifier(t *testing.T) {
+	const issuer = "https://idp.example.com"
+	exp := time.Now().Add(time.Hour).Unix()
+	srv := newIntrospectionServer(t, map[string]map[string]any{
+		"opaque-svc":   {"active": true, "scope": "nats:admin nats:publish", "client_id": "svc", "exp": exp, "aud": "nats"},
+		"opaque-user":  {"active": true, "scope": "nats:subscribe", "sub": "alice", "client_id": "app", "exp": exp, "aud": "nats"},
+		"other-aud":    {"active": true, "sub": "alice", "exp": exp, "aud": "other"},
+		"other-issuer": {"active": true, "sub": "alice", "exp": exp, "aud": "nats", "iss": "https://evil.example.com"},
+		"no-exp":       {"active": true, "sub": "alice", "aud": "nats"},
+	})
+	t.Setenv("TEST_INTROSPECTION_SECRET", "s3cret%")
+
+	v, err := NewIntrospectionVerifier(context.Background(), IssuerConfig{
+		URL:              issuer,
+		Type:             IssuerTypeIntrospection,
+		Audience:         "nats",
+		IntrospectionURL: srv.URL,
+		ClientID:         "nats-auth",
+		ClientSecretEnv:  "TEST_INTROSPECTION_SECRET",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verifiers := NewVerifierSet(v)
+
+	claims, iss, err := ValidateToken(context.Background(), "opaque-svc", verifiers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if iss != issuer || claims.Subject != "svc" || len(claims.Scopes) != 2 || claims.Expiry.Unix() != exp {
+		t.Errorf("unexpected claims from %s: %+v", iss, claims)
+	}
+	if claims, _, err := ValidateToken(context.Background(), "opaque-user", verifiers); err != nil || claims.Subject != "alice" || claims.ClientID != "app" {
+		t.Errorf("unexpected result: %+v %v", claims, err)
+	}
+
+	for token, code := range map[string]string{
+		"revoked":      "token_inactive",
+		"other-aud":    "audience_mismatch",
+		"other-issuer": "introspection_failed",
+		"no-exp":       "malformed_token",
+	} {
+		_, iss, err := ValidateToken(context.Background(), token, verifiers)
+		var tokenErr *TokenError
+		if !errors.As(err, &tokenErr) || tokenErr.Code() != code || iss != issuer {
+			t.Errorf("%s: expected %s from %s, got %q %v", token, code, issuer, iss, err)
+		}
+	}
+
+	v.clientSecret = "wrong"
+	if _, _, err := ValidateToken(context.Background(), "opaque-svc", verifiers); !errors.Is(err, ErrIntrospection) {
+		t.Errorf("expected introspection failure with wrong credentials, got %v", err)
+	}
+}
+
+func TestValidateToken_OpaqueRouting(t *testing.T) {
+	jwtIssuer := newFakeIssuer(t, "https://login.example.com")
+	verifiers := NewVerifierSet(jwtIssuer.verifier())
+
+	// Without an introspection issuer an opaque token is malformed.
+	if _, _, err := ValidateToken(context.Background(), "opaque", verifiers); !errors.Is(err, ErrMalformedToken) {
+		t.Errorf("expected malformed token, got %v", err)
+	}
+
+	// With two introspection issuers it is sent to neither.
+	t.Setenv("TEST_INTROSPECTION_SECRET", "s3cret%")
+	for _, issuer := range []string{"https://a.example.com", "https://b.example.com"} {
+		v, err := NewIntrospectionVerifier(context.Background(), IssuerConfig{URL: issuer, Type: IssuerTypeIntrospection,
+			IntrospectionURL: "http://127.0.0.1:0", ClientID: "nats-auth", ClientSecretEnv: "TEST_INTROSPECTION_SECRET"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifiers.issuers[issuer] = &issuerEntry{config: v.Config(), verifier: v}
+	}
+	if _, _, err := ValidateToken(context.Background(), "opaque", verifiers); !errors.Is(err, ErrUnknownIssuer) {
+		t.Errorf("expected ambiguous opaque token to be rejected, got %v", err)
+	}
+
+	// JWTs are still routed by iss.
+	if _, _, err := ValidateToken(context.Background(), jwtIssuer.sign(t, "svc", "nats:admin", time.Hour, nil), verifiers); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Issuer verification types.
+const (
+	IssuerTypeJWT           = "jwt"
+	IssuerTypeIntrospection = "introspection"
+)
+
+// IssuerConfig configures one trusted OIDC issuer.
+type IssuerConfig struct {
+	URL string `json:"url"`
+
+	// Type selects how tokens are verified: "jwt" (the default) checks the
+	// signature locally, "introspection" asks the issuer's RFC 7662
+	// introspection endpoint and also accepts opaque tokens.
+	Type string `json:"type,omitempty"`
+
+	// Profile selects the token rules: "" accepts any OIDC-signed JWT,
+	// "access_token" enforces the RFC 9068 JWT access token profile.
+	Profile string `json:"profile,omitempty"`
+
+	// RejectIDTokens rejects tokens carrying ID token claims (nonce,
+	// at_hash, c_hash, s_hash, azp) or addressed to one of IDTokenAudiences,
+	// for issuers whose access tokens do not use the at+jwt type.
+	RejectIDTokens bool `json:"reject_id_tokens,omitempty"`
+
+	// IDTokenAudiences are the client IDs of the issuer's login clients.
+	// An ID token's aud is the client it was issued to, so with
+	// RejectIDTokens a token addressed to one of them is rejected.
+	IDTokenAudiences []string `json:"id_token_audiences,omitempty"`
+
+	// ReplayProtection accepts each token only once, keyed by its jti, which
+	// becomes required.
+	ReplayProtection bool `json:"replay_protection,omitempty"`
+
+	// JWKSFile or JWKS (inline) supply the issuer's signing keys, so no
+	// discovery or key fetch is made. The file is reloaded when it changes.
+	JWKSFile string          `json:"jwks_file,omitempty"`
+	JWKS     json.RawMessage `json:"jwks,omitempty"`
+
+	// IntrospectionURL overrides the introspection_endpoint from discovery.
+	IntrospectionURL string `json:"introspection_url,omitempty"`
+
+	// ClientID and the secret in the ClientSecretEnv environment variable
+	// authenticate introspection requests.
+	ClientID        string `json:"client_id,omitempty"`
+	ClientSecretEnv string `json:"client_secret_env,omitempty"`
+
+	// Audience must appear in the token's aud claim when set.
+	Audience string `json:"audience,omitempty"`
+
+	// Algorithms restricts the accepted signing algorithms, e.g. ["ES256"].
+	// The provider's advertised algorithms are accepted when empty.
+	Algorithms []string `json:"algorithms,omitempty"`
+
+	// ClockSkew is the tolerance applied to exp, nbf and iat.
+	ClockSkew Duration `json:"clock_skew,omitempty"`
+
+	// MaxTokenAge rejects tokens whose iat is older than this when set.
+	MaxTokenAge Duration `json:"max_token_age,omitempty"`
+}
+
+// Token profiles.
+const (
+	ProfileAccessToken = "access_token"
+)
+
+// validate checks settings that do not depend on the issuer being reachable.
+func (c IssuerConfig) validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	switch c.Type {
+	case "", IssuerTypeJWT:
+	case IssuerTypeIntrospection:
+		if c.ClientID == "" || c.ClientSecretEnv == "" {
+			return fmt.Errorf("issuer %s: introspection requires client_id and client_secret_env", c.URL)
+		}
+	default:
+		return fmt.Errorf("issuer %s: unknown type %q", c.URL, c.Type)
+	}
+	if c.JWKSFile != "" || len(c.JWKS) > 0 {
+		if c.Type == IssuerTypeIntrospection {
+			return fmt.Errorf("issuer %s: static keys do not apply to introspection", c.URL)
+		}
+		if c.JWKSFile != "" && len(c.JWKS) > 0 {
+			return fmt.Errorf("issuer %s: set jwks_file or jwks, not both", c.URL)
+		}
+		if len(c.JWKS) > 0 {
+			if _, err := parseJWKS(c.JWKS); err != nil {
+				return fmt.Errorf("issuer %s: jwks: %w", c.URL, err)
+			}
+		}
+	}
+	if len(c.IDTokenAudiences) > 0 && !c.RejectIDTokens {
+		return fmt.Errorf("issuer %s: id_token_audiences requires reject_id_tokens", c.URL)
+	}
+	switch c.Profile {
+	case "":
+	case ProfileAccessToken:
+		if c.Type == IssuerTypeIntrospection {
+			return fmt.Errorf("issuer %s: the %s profile applies to JWTs, not introspection", c.URL, c.Profile)
+		}
+		if c.Audience == "" {
+			return fmt.Errorf("issuer %s: the %s profile requires an audience", c.URL, c.Profile)
+		}
+	default:
+		return fmt.Errorf("issuer %s: unknown profile %q", c.URL, c.Profile)
+	}
+	return nil
+}
+
+// Duration is a time.Duration written as a string such as "30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration { return time.Duration(d) }
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("duration %s must not be negative", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// IssuerStatus reports whether an issuer is ready to verify tokens.
+type IssuerStatus struct {
+	URL   string `json:"url"`
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+// TokenVerifier verifies the tokens of one issuer.
+type TokenVerifier interface {
+	Config() IssuerConfig
+	Verify(ctx context.Context, rawToken string) (*OIDCClaims, error)
+}
+
+// NewTokenVerifier builds the verifier selected by cfg.Type.
+func NewTokenVerifier(ctx context.Context, cfg IssuerConfig) (TokenVerifier, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Type == IssuerTypeIntrospection {
+		return NewIntrospectionVerifier(ctx, cfg)
+	}
+	return NewOIDCVerifier(ctx, cfg)
+}
+
+// issuerEntry is a configured issuer. verifier is nil while provider
+// discovery is pending; lastErr holds the latest discovery failure. When an
+// issuer is reconfigured, previous is the verifier built for the old
+// configuration, which keeps serving until verifier is ready.
+type issuerEntry struct {
+	config   IssuerConfig
+	verifier TokenVerifier
+	previous TokenVerifier
+	lastErr  error
+	cancel   context.CancelFunc
+}
+
+// VerifierSet routes tokens to the verifier of the issuer named in their
+// iss claim. Issuers can be added and removed at runtime; an added issuer
+// stays pending until discovery succeeds, retried in the background with
+// exponential backoff.
+type VerifierSet struct {
+	mu      sync.RWMutex
+	issuers map[string]*issuerEntry
+
+	// discover builds a verifier; NewTokenVerifier unless replaced in tests.
+	discover func(ctx context.Context, cfg IssuerConfig) (TokenVerifier, error)
+
+	retryMin time.Duration
+	retryMax time.Duration
+
+	// cache, when set, serves repeated validations of the same token.
+	cache *TokenCache
+
+	// replay records the jti of tokens from issuers with replay protection.
+	replay ReplayStore
+}
+
+// SetReplayStore sets where issuers with replay protection record used
+// tokens.
+func (s *VerifierSet) SetReplayStore(store ReplayStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replay = store
+}
+
+// SetCache makes ValidateToken serve repeated validations from cache. The
+// cache is purged whenever an issuer is removed or reconfigured.
+func (s *VerifierSet) SetCache(cache *TokenCache) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = cache
+}
+
+func (s *VerifierSet) tokenCache() *TokenCache {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache
+}
+
+// watchKeys makes a reload of v's static key file purge the cache, so a
+// token signed with a retired key is not served from it. It is called
+// before v is added to the set.
+func (s *VerifierSet) watchKeys(v TokenVerifier) {
+	if o, ok := v.(*OIDCVerifier); ok && o.keys != nil {
+		o.keys.onReload = func() {
+			if cache := s.tokenCache(); cache != nil {
+				cache.Purge()
+			}
+		}
+	}
+}
+
+// refreshKeys checks the static key files of the set's issuers for changes.
+// Cached results skip signature checks, so without it a rotated file would
+// only be noticed on the next cache miss.
+func (s *VerifierSet) refreshKeys() {
+	var keys []*staticKeySet
+	s.mu.RLock()
+	for _, e := range s.issuers {
+		for _, v := range []TokenVerifier{e.verifier, e.previous} {
+			if o, ok := v.(*OIDCVerifier); ok && o.keys != nil {
+				keys = append(keys, o.keys)
+			}
+		}
+	}
+	s.mu.RUnlock()
+	for _, k := range keys {
+		k.refresh()
+	}
+}
+
+// NewVerifierSet creates a set holding already initialized verifiers.
+func NewVerifierSet(verifiers ...TokenVerifier) *VerifierSet {
+	s := &VerifierSet{
+		issuers:  make(map[string]*issuerEntry, len(verifiers)),
+		discover: NewTokenVerifier,
+		retryMin: time.Second,
+		retryMax: time.Minute,
+	}
+	for _, v := range verifiers {
+		cfg := v.Config()
+		s.watchKeys(v)
+		s.issuers[cfg.URL] = &issuerEntry{config: cfg, verifier: v}
+	}
+	return s
+}
+
+// Sync makes configs the set of trusted issuers. New issuers start pending
+// and are discovered in the background until ctx is cancelled. An issuer
+// whose configuration changed keeps verifying tokens with its old
+// configuration until the new one has been discovered, then switches over.
+// Issuers missing from configs are removed immediately.
+func (s *VerifierSet) Sync(ctx context.Context, configs []IssuerConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[string]IssuerConfig, len(configs))
+	for _, cfg := range configs {
+		wanted[cfg.URL] = cfg
+	}
+	replaced := make(map[string]TokenVerifier)
+	for url, e := range s.issuers {
+		cfg, ok := wanted[url]
+		if ok && reflect.DeepEqual(cfg, e.config) {
+			continue
+		}
+		if e.cancel != nil {
+			e.cancel()
+		}
+		delete(s.issuers, url)
+		switch {
+		case !ok:
+			if s.cache != nil {
+				s.cache.Purge()
+			}
+			log.Printf("Removed OIDC issuer %s", url)
+		case e.verifier != nil:
+			replaced[url] = e.verifier
+		case e.previous != nil:
+			// Reconfigured again while pending: keep the verifier that was serving.
+			replaced[url] = e.previous
+		}
+	}
+	for url, cfg := range wanted {
+		if _, ok := s.issuers[url]; ok {
+			continue
+		}
+		dctx, cancel := context.WithCancel(ctx)
+		e := &issuerEntry{config: cfg, previous: replaced[url], cancel: cancel}
+		s.issuers[url] = e
+		if e.previous != nil {
+			log.Printf("Reconfigured OIDC issuer %s (previous configuration serves until discovery completes)", url)
+		} else {
+			log.Printf("Added OIDC issuer %s (pending discovery)", url)
+		}
+		go s.initialize(dctx, e)
+	}
+}
+
+// initialize retries discovery for e until it succeeds or the issuer is
+// removed.
+func (s *VerifierSet) initialize(ctx context.Context, e *issuerEntry) {
+	delay := s.retryMin
+	for attempt := 1; ; attempt++ {
+		actx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		v, err := s.discover(actx, e.config)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			s.watchKeys(v)
+		}
+
+		s.mu.Lock()
+		if err == nil {
+			// Results cached under the previous configuration no longer apply.
+			if e.previous != nil && s.cache != nil {
+				s.cache.Purge()
+			}
+			e.verifier, e.previous, e.lastErr = v, nil, nil
+		} else {
+			e.lastErr = err
+		}
+		s.mu.Unlock()
+
+		if err == nil {
+			log.Printf("OIDC verifier ready for %s (attempt %d)", e.config.URL, attempt)
+			return
+		}
+		log.Printf("OIDC provider not ready at %s (attempt %d, retrying in %s): %v", e.config.URL, attempt, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, s.retryMax)
+	}
+}
+
+// lookup returns the ready verifier for issuer.
+func (s *VerifierSet) lookup(issuer string) (TokenVerifier, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.issuers[issuer]
+	if !ok {
+		return nil, ErrUnknownIssuer
+	}
+	return e.ready()
+}
+
+// lookupOpaque returns the verifier for tokens that are not JWTs and so name
+// no issuer: the only introspection issuer. With several configured the
+// token is not sent to any of them.
+func (s *VerifierSet) lookupOpaque() (string, TokenVerifier, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found []*issuerEntry
+	for _, e := range s.issuers {
+		if e.config.Type == IssuerTypeIntrospection {
+			found = append(found, e)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil, nil
+	case 1:
+		v, err := found[0].ready()
+		return found[0].config.URL, v, err
+	default:
+		return "", nil, fmt.Errorf("%w: opaque token with %d introspection issuers configured", ErrUnknownIssuer, len(found))
+	}
+}
+
+func (e *issuerEntry) ready() (TokenVerifier, error) {
+	switch {
+	case e.verifier != nil:
+		return e.verifier, nil
+	case e.previous != nil:
+		return e.previous, nil
+	case e.lastErr != nil:
+		return nil, fmt.Errorf("%w: %v", ErrIssuerNotReady, e.lastErr)
+	default:
+		return nil, fmt.Errorf("%w: discovery in progress", ErrIssuerNotReady)
+	}
+}
+
+// Issuers returns the configured issuer URLs in sorted order.
+func (s *VerifierSet) Issuers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedKeys(s.issuers)
+}
+
+// Status reports the state of every configured issuer, sorted by URL.
+func (s *VerifierSet) Status() []IssuerStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []IssuerStatus
+	for _, url := range sortedKeys(s.issuers) {
+		e := s.issuers[url]
+		st := IssuerStatus{URL: url, Ready: e.verifier != nil || e.previous != nil}
+		if e.verifier == nil && e.lastErr != nil {
+			st.Error = e.lastErr.Error()
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// ParseIssuerURLs reads a comma-separated OIDC_ISSUER_URL value, applying
+// audience to every issuer.
+func ParseIssuerURLs(urls, audience string) []IssuerConfig {
+	var configs []IssuerConfig
+	for _, url := range strings.Split(urls, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			configs = append(configs, IssuerConfig{URL: url, Audience: audience})
+		}
+	}
+	return configs
+}
+
+// LoadIssuersFile reads a JSON array of issuer configurations.
+func LoadIssuersFile(path string) ([]IssuerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read issuers file %s: %w", path, err)
+	}
+	var configs []IssuerConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse issuers file %s: %w", path, err)
+	}
+	seen := make(map[string]bool, len(configs))
+	for i, cfg := range configs {
+		if err := cfg.validate(); err != nil {
+			return nil, fmt.Errorf("issuer %d in %s: %w", i, path, err)
+		}
+		if seen[cfg.URL] {
+			return nil, fmt.Errorf("issuer %s listed twice in %s", cfg.URL, path)
+		}
+		seen[cfg.URL] = true
+	}
+	return configs, nil
+}
+
+// WatchIssuersFile syncs the set to the static issuers plus those in the
+// issuers file whenever the file's modification time changes, until ctx is
+// cancelled. A file that fails to load leaves the current issuers in place.
+func (s *VerifierSet) WatchIssuersFile(ctx context.Context, path string, static []IssuerConfig, interval time.Duration) {
+	var lastMod time.Time
+	if fi, err := os.Stat(path); err == nil {
+		lastMod = fi.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = fi.ModTime()
+		configs, err := LoadIssuersFile(path)
+		if err != nil {
+			log.Printf("Keeping current issuers: %v", err)
+			continue
+		}
+		s.Sync(ctx, append(append([]IssuerConfig{}, static...), configs...))
+		log.Printf("Reloaded issuers from %s: %v", path, s.Issuers())
+	}
+}
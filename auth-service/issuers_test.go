@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVerifierSet_PendingIssuerRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	issuer := newFakeIssuer(t, "https://login.example.com")
+	var attempts atomic.Int32
+	var up atomic.Bool
+	set := NewVerifierSet()
+	set.retryMin, set.retryMax = time.Millisecond, 5*time.Millisecond
+	set.discover = func(ctx context.Context, cfg IssuerConfig) (TokenVerifier, error) {
+		attempts.Add(1)
+		if !up.Load() {
+			return nil, errors.New("connection refused")
+		}
+		return issuer.verifier(), nil
+	}
+	token := issuer.sign(t, "svc", "nats:admin", time.Hour, nil)
+
+	set.Sync(ctx, []IssuerConfig{{URL: issuer.url}})
+	waitFor(t, "retries", func() bool { return attempts.Load() >= 3 })
+	if _, _, err := ValidateToken(ctx, token, set); !errors.Is(err, ErrIssuerNotReady) {
+		t.Fatalf("expected pending issuer to be reported as not ready, got %v", err)
+	}
+
+	up.Store(true)
+	waitFor(t, "issuer discovery", func() bool { return set.Status()[0].Ready })
+	if _, _, err := ValidateToken(ctx, token, set); err != nil {
+		t.Fatalf("unexpected error once ready: %v", err)
+	}
+
+	set.Sync(ctx, nil)
+	if _, _, err := ValidateToken(ctx, token, set); !errors.Is(err, ErrUnknownIssuer) {
+		t.Errorf("expected removed issuer to be unknown, got %v", err)
+	}
+}
+
+func TestVerifierSet_ReconfiguredIssuerKeepsServing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	issuer := newFakeIssuer(t, "https://login.example.com")
+	var up atomic.Bool
+	set := NewVerifierSet()
+	set.retryMin, set.retryMax = time.Millisecond, 5*time.Millisecond
+	set.discover = func(ctx context.Context, cfg IssuerConfig) (TokenVerifier, error) {
+		if cfg.Audience != "" && !up.Load() {
+			return nil, errors.New("connection refused")
+		}
+		return issuer.configured(cfg), nil
+	}
+	token := issuer.sign(t, "svc", "nats:admin", time.Hour, nil)
+
+	set.Sync(ctx, []IssuerConfig{{URL: issuer.url}})
+	waitFor(t, "issuer discovery", func() bool { return set.Status()[0].Ready })
+
+	// While the new configuration is pending, the old verifier keeps serving.
+	set.Sync(ctx, []IssuerConfig{{URL: issuer.url, Audience: "nats"}})
+	waitFor(t, "failed rediscovery", func() bool { return set.Status()[0].Error != "" })
+	if _, _, err := ValidateToken(ctx, token, set); err != nil {
+		t.Fatalf("expected the previous configuration to keep serving, got %v", err)
+	}
+	if !set.Status()[0].Ready {
+		t.Fatal("expected the issuer to stay ready")
+	}
+
+	// Once ready, the new configuration replaces it.
+	up.Store(true)
+	waitFor(t, "swap to the new configuration", func() bool { return set.Status()[0].Error == "" })
+	if _, _, err := ValidateToken(ctx, token, set); err == nil {
+		t.Error("expected the new audience requirement to apply")
+	}
+}
+
+func TestVerifierSet_NotReadyReason(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	issuer := newFakeIssuer(t, "https://login.example.com")
+	set := NewVerifierSet()
+	set.retryMin, set.retryMax = time.Hour, time.Hour
+	set.discover = func(context.Context, IssuerConfig) (TokenVerifier, error) {
+		return nil, errors.New("503 Service Unavailable")
+	}
+	set.Sync(ctx, []IssuerConfig{{URL: issuer.url}})
+	waitFor(t, "failed discovery", func() bool { return set.Status()[0].Error != "" })
+
+	_, _, err := ValidateToken(ctx, issuer.sign(t, "svc", "nats:admin", time.Hour, nil), set)
+	if !errors.Is(err, ErrIssuerNotReady) || err.Error() != "issuer https://login.example.com (kid key-1): issuer not ready: 503 Service Unavailable" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadIssuersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "issuers.json")
+	write := func(doc string) {
+		if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`[{"url": "https://a.example.com", "audience": "nats"}, {"url": "https://b.example.com"}]`)
+	configs, err := LoadIssuersFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(configs) != 2 || configs[0].Audience != "nats" {
+		t.Errorf("unexpected issuers %+v", configs)
+	}
+
+	for _, doc := range []string{
+		`[{"audience": "nats"}]`,
+		`[{"url": "https://a"}, {"url": "https://a"}]`,
+		`{`,
+		`[{"url": "https://a", "type": "saml"}]`,
+		`[{"url": "https://a", "type": "introspection", "client_id": "nats-auth"}]`,
+		`[{"url": "https://a", "profile": "access_token"}]`,
+		`[{"url": "https://a", "profile": "saml"}]`,
+	} {
+		write(doc)
+		if _, err := LoadIssuersFile(path); err == nil {
+			t.Errorf("%s: expected an error", doc)
+		}
+	}
+}
+
+func TestIssuerConfig_Durations(t *testing.T) {
+	var cfg IssuerConfig
+	if err := json.Unmarshal([]byte(`{"url":"https://a","clock_skew":"30s","max_token_age":"1h"}`), &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ClockSkew.Duration() != 30*time.Second || cfg.MaxTokenAge.Duration() != time.Hour {
+		t.Errorf("unexpected durations: %+v", cfg)
+	}
+	for _, doc := range []string{`{"clock_skew":30}`, `{"clock_skew":"soon"}`, `{"max_token_age":"-1m"}`} {
+		if err := json.Unmarshal([]byte(doc), &cfg); err == nil {
+			t.Errorf("%s: expected error", doc)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// staticKeyAlgorithms are the signing algorithms accepted with a static key
+// set when the issuer configures none. Only keys in the set can verify, and
+// symmetric algorithms are excluded so a public key is never used as an
+// HMAC secret.
+var staticKeyAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// staticKeySet is an oidc.KeySet backed by a local JWKS file or inline keys,
+// for issuers that cannot be reached for discovery. A file is re-read when
+// its modification time changes, checked at most once per reloadInterval,
+// so keys are rotated by redeploying the file.
+type staticKeySet struct {
+	path           string // empty for inline keys
+	reloadInterval time.Duration
+
+	// onReload, when set, is called after the file's keys are replaced.
+	onReload func()
+
+	mu      sync.Mutex
+	keys    *jose.JSONWebKeySet
+	modTime time.Time
+	checked time.Time
+}
+
+// newStaticKeySet loads the keys configured for cfg.
+func newStaticKeySet(cfg IssuerConfig) (*staticKeySet, error) {
+	if cfg.JWKSFile == "" {
+		keys, err := parseJWKS(cfg.JWKS)
+		if err != nil {
+			return nil, fmt.Errorf("issuer %s: inline jwks: %w", cfg.URL, err)
+		}
+		return &staticKeySet{keys: keys}, nil
+	}
+	s := &staticKeySet{path: cfg.JWKSFile, reloadInterval: 5 * time.Second}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("issuer %s: %w", cfg.URL, err)
+	}
+	return s, nil
+}
+
+// parseJWKS decodes a JWKS document holding at least one public key.
+func parseJWKS(data []byte) (*jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("JWKS holds no keys")
+	}
+	for _, k := range keys.Keys {
+		if !k.IsPublic() {
+			return nil, fmt.Errorf("key %q is not a public key", k.KeyID)
+		}
+	}
+	return &keys, nil
+}
+
+// load reads the file unconditionally; the caller holds mu or owns s.
+func (s *staticKeySet) load() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.keys, s.modTime, s.checked = keys, fi.ModTime(), time.Now()
+	return nil
+}
+
+// current returns the key set, reloading the file first if it changed.
+func (s *staticKeySet) current() *jose.JSONWebKeySet {
+	s.refresh()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys
+}
+
+// refresh reloads the file if it changed and calls onReload when the keys
+// were replaced. A file that fails to load leaves the current keys in place.
+func (s *staticKeySet) refresh() {
+	if s.path == "" {
+		return
+	}
+	s.mu.Lock()
+	if time.Since(s.checked) < s.reloadInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.checked = time.Now()
+	fi, err := os.Stat(s.path)
+	if err != nil || fi.ModTime().Equal(s.modTime) {
+		s.mu.Unlock()
+		return
+	}
+	if err := s.load(); err != nil {
+		s.mu.Unlock()
+		log.Printf("Keeping current keys: %v", err)
+		return
+	}
+	log.Printf("Reloaded JWKS from %s (%d keys)", s.path, len(s.keys.Keys))
+	onReload := s.onReload
+	s.mu.Unlock()
+	if onReload != nil {
+		onReload()
+	}
+}
+
+// VerifySignature implements oidc.KeySet. A token naming a kid is only
+// checked against keys with that ID.
+func (s *staticKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt, staticKeyAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("parsing jwt: %v", err)
+	}
+	set := s.current()
+	keys := set.Keys
+	if kid := jws.Signatures[0].Header.KeyID; kid != "" {
+		keys = set.Key(kid)
+	}
+	for _, k := range keys {
+		if k.Use == "enc" {
+			continue
+		}
+		if payload, err := jws.Verify(k.Key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, fmt.Errorf("no configured key verifies the token")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// jwks returns the issuer's public key as a JWKS document.
+func (i *fakeIssuer) jwks(t *testing.T) []byte {
+	t.Helper()
+	data, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: i.key.Public(), KeyID: i.kid, Algorithm: string(jose.RS256), Use: "sig"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStaticJWKS_Inline(t *testing.T) {
+	iss := newFakeIssuer(t, "https://edge-idp.example.com")
+	cfg := IssuerConfig{URL: iss.url, JWKS: iss.jwks(t)}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The issuer URL is unreachable; no discovery may be attempted.
+	v, err := NewTokenVerifier(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verifiers := NewVerifierSet(v)
+
+	if _, _, err := ValidateToken(context.Background(), iss.sign(t, "svc", "nats:admin", time.Hour, nil), verifiers); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other := newFakeIssuer(t, iss.url)
+	if _, _, err := ValidateToken(context.Background(), other.sign(t, "svc", "nats:admin", time.Hour, nil), verifiers); err == nil {
+		t.Error("expected a token signed by another key to fail")
+	}
+
+	for _, doc := range []string{`{"keys": []}`, `{`, string(mustMarshal(t, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: iss.key, KeyID: "private"}}}))} {
+		cfg := IssuerConfig{URL: iss.url, JWKS: json.RawMessage(doc)}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%.30s: expected an error", doc)
+		}
+	}
+}
+
+func TestStaticJWKS_FileReload(t *testing.T) {
+	oldKey := newFakeIssuer(t, "https://edge-idp.example.com")
+	newKey := newFakeIssuer(t, oldKey.url)
+	newKey.kid = "key-2"
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	write := func(data []byte, mod time.Time) {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(oldKey.jwks(t), time.Now().Add(-time.Hour))
+
+	v, err := NewOIDCVerifier(context.Background(), IssuerConfig{URL: oldKey.url, JWKSFile: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v.keys.reloadInterval = 0
+	verifiers := NewVerifierSet(v)
+	validate := func(iss *fakeIssuer) error {
+		_, _, err := ValidateToken(context.Background(), iss.sign(t, "svc", "nats:admin", time.Hour, nil), verifiers)
+		return err
+	}
+
+	if err := validate(oldKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := validate(newKey); err == nil {
+		t.Fatal("expected the unrotated key set to reject the new key")
+	}
+
+	write(newKey.jwks(t), time.Now())
+	if err := validate(newKey); err != nil {
+		t.Fatalf("expected rotated key to verify: %v", err)
+	}
+	if err := validate(oldKey); err == nil {
+		t.Error("expected the retired key to be rejected")
+	}
+
+	// A broken file keeps the current keys.
+	write([]byte("{"), time.Now().Add(time.Minute))
+	if err := validate(newKey); err != nil {
+		t.Errorf("expected current keys to remain after a bad reload: %v", err)
+	}
+}
+
+func TestStaticJWKS_ReloadPurgesCache(t *testing.T) {
+	oldKey := newFakeIssuer(t, "https://edge-idp.example.com")
+	newKey := newFakeIssuer(t, oldKey.url)
+	newKey.kid = "key-2"
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, oldKey.jwks(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewOIDCVerifier(context.Background(), IssuerConfig{URL: oldKey.url, JWKSFile: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v.keys.reloadInterval = 0
+	verifiers := NewVerifierSet(v)
+	verifiers.SetCache(NewTokenCache(time.Hour, 0, nil))
+	token := oldKey.sign(t, "svc", "nats:admin", time.Hour, nil)
+	if _, _, err := ValidateToken(context.Background(), token, verifiers); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if verifiers.tokenCache().Len() != 1 {
+		t.Fatal("expected the result to be cached")
+	}
+
+	// Retiring the key must not leave its tokens in the cache.
+	if err := os.WriteFile(path, newKey.jwks(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ValidateToken(context.Background(), token, verifiers); err == nil {
+		t.Error("expected a token signed with the retired key to be rejected")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// AuthPolicyResource identifies the AuthPolicy custom resource. Its spec is
+// a policy document (or a signed bundle) and its status holds conditions.
+var AuthPolicyResource = schema.GroupVersionResource{Group: "natsauth.io", Version: "v1alpha1", Resource: "authpolicies"}
+
+const (
+	// PolicyConditionType is the condition reporting whether the resource
+	// holds a policy that passed validation.
+	PolicyConditionType = "PolicyValid"
+
+	// PolicyConditionAnnotation carries the condition on ConfigMaps, which
+	// have no status.
+	PolicyConditionAnnotation = "natsauth.io/policy-condition"
+
+	// DefaultConfigMapKey is the ConfigMap data key holding the policy.
+	DefaultConfigMapKey = "policy.json"
+)
+
+// KubePolicySource watches a ConfigMap or an AuthPolicy resource through an
+// informer and activates each revision that passes validation. A rejected
+// revision leaves the previous policy in effect and is reported on the
+// resource with a PolicyValid=False condition.
+type KubePolicySource struct {
+	namespace string
+	name      string
+	key       string // ConfigMap data key; empty for AuthPolicy
+	trust     *PolicyTrust
+
+	core    kubernetes.Interface
+	dynamic dynamic.Interface
+
+	mu       sync.Mutex
+	current  *Policy
+	onChange func(*Policy)
+}
+
+// NewConfigMapPolicySource watches the policy stored under key in a ConfigMap.
+func NewConfigMapPolicySource(client kubernetes.Interface, namespace, name, key string, trust *PolicyTrust) *KubePolicySource {
+	if key == "" {
+		key = DefaultConfigMapKey
+	}
+	return &KubePolicySource{namespace: namespace, name: name, key: key, trust: trust, core: client}
+}
+
+// NewAuthPolicySource watches an AuthPolicy custom resource.
+func NewAuthPolicySource(client dynamic.Interface, namespace, name string, trust *PolicyTrust) *KubePolicySource {
+	return &KubePolicySource{namespace: namespace, name: name, trust: trust, dynamic: client}
+}
+
+// KubeClientConfig returns the in-cluster config, or the KUBECONFIG file
+// when running outside a cluster.
+func KubeClientConfig() (*rest.Config, error) {
+	if path := os.Getenv("KUBECONFIG"); path != "" {
+		return clientcmd.BuildConfigFromFlags("", path)
+	}
+	return rest.InClusterConfig()
+}
+
+// ParseObjectRef splits a "namespace/name" reference.
+func ParseObjectRef(ref string) (namespace, name string, err error) {
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("invalid reference %q, expected namespace/name", ref)
+	}
+	return namespace, name, nil
+}
+
+func (s *KubePolicySource) source() string {
+	if s.dynamic != nil {
+		return "authpolicy:" + s.namespace + "/" + s.name
+	}
+	return "configmap:" + s.namespace + "/" + s.name
+}
+
+// Start runs the informer until ctx is cancelled. It returns the policy in
+// the resource once the informer has synced, and fails when the resource is
+// missing or invalid.
+func (s *KubePolicySource) Start(ctx context.Context) (*Policy, error) {
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.sync,
+		UpdateFunc: func(_, obj any) { s.sync(obj) },
+		DeleteFunc: func(any) {
+			log.Printf("Policy resource %s deleted; keeping the last valid policy", s.source())
+		},
+	}
+	byName := func(opts *metav1.ListOptions) {
+		opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", s.name).String()
+	}
+
+	var informer cache.SharedIndexInformer
+	if s.dynamic != nil {
+		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(s.dynamic, 0, s.namespace, byName)
+		informer = factory.ForResource(AuthPolicyResource).Informer()
+	} else {
+		factory := informers.NewSharedInformerFactoryWithOptions(s.core, 0,
+			informers.WithNamespace(s.namespace), informers.WithTweakListOptions(byName))
+		informer = factory.Core().V1().ConfigMaps().Informer()
+	}
+	if _, err := informer.AddEventHandler(handler); err != nil {
+		return nil, err
+	}
+	go informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return nil, fmt.Errorf("%s: informer did not sync", s.source())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return nil, fmt.Errorf("%s: no valid policy found", s.source())
+	}
+	return s.current, nil
+}
+
+// OnChange registers fn to receive every policy accepted from now on. It is
+// called once with the current policy so no revision is missed.
+func (s *KubePolicySource) OnChange(fn func(*Policy)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = fn
+	if s.current != nil {
+		fn(s.current)
+	}
+}
+
+// Current returns the last accepted policy, or nil before the first one.
+func (s *KubePolicySource) Current() *Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// sync handles an added or updated object.
+func (s *KubePolicySource) sync(obj any) {
+	mobj, err := meta.Accessor(obj)
+	if err != nil || mobj.GetName() != s.name || mobj.GetNamespace() != s.namespace {
+		return
+	}
+
+	policy, err := s.parse(obj)
+	if err != nil {
+		log.Printf("Rejected policy from %s (resource version %s): %v", s.source(), mobj.GetResourceVersion(), err)
+		s.setCondition(obj, metav1.ConditionFalse, "ValidationFailed", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	changed := s.current == nil || s.current.Meta.Digest != policy.Meta.Digest
+	if changed {
+		s.current = policy
+		if s.onChange != nil {
+			s.onChange(policy)
+		}
+	}
+	s.mu.Unlock()
+	if changed {
+		log.Printf("Loaded policy (%d scopes): %s", len(policy.Scopes), policy.Meta)
+	}
+	s.setCondition(obj, metav1.ConditionTrue, "Valid", "policy loaded: "+policy.Meta.String())
+}
+
+// parse extracts and validates the policy document in obj.
+func (s *KubePolicySource) parse(obj any) (*Policy, error) {
+	var data []byte
+	switch o := obj.(type) {
+	case *corev1.ConfigMap:
+		doc, ok := o.Data[s.key]
+		if !ok {
+			return nil, fmt.Errorf("configmap has no %q key", s.key)
+		}
+		data = []byte(doc)
+	case *unstructured.Unstructured:
+		spec, ok := o.Object["spec"]
+		if !ok {
+			return nil, fmt.Errorf("authpolicy has no spec")
+		}
+		var err error
+		if data, err = json.Marshal(spec); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+
+	doc, info, err := OpenPolicyDocument(data, s.source(), s.trust, BundleTarget{Kind: BundlePolicy})
+	if err != nil {
+		return nil, err
+	}
+	if current := s.Current(); current != nil {
+		if err := checkVersion(info, current.Meta); err != nil {
+			return nil, err
+		}
+	}
+	policy, err := ParsePolicy(doc)
+	if err != nil {
+		return nil, err
+	}
+	policy.Meta = info
+	return policy, nil
+}
+
+// setCondition writes the PolicyValid condition back to the resource when it
+// differs from the recorded one. Writes are skipped when nothing changed so
+// the resulting update events do not loop.
+func (s *KubePolicySource) setCondition(obj any, status metav1.ConditionStatus, reason, message string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cond := metav1.Condition{
+		Type:               PolicyConditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	}
+
+	var err error
+	switch o := obj.(type) {
+	case *corev1.ConfigMap:
+		var conditions []metav1.Condition
+		if raw, ok := o.Annotations[PolicyConditionAnnotation]; ok {
+			var existing metav1.Condition
+			if json.Unmarshal([]byte(raw), &existing) == nil {
+				conditions = append(conditions, existing)
+			}
+		}
+		if !updateCondition(&conditions, cond) {
+			return
+		}
+		encoded, _ := json.Marshal(conditions[0])
+		cm := o.DeepCopy()
+		if cm.Annotations == nil {
+			cm.Annotations = map[string]string{}
+		}
+		cm.Annotations[PolicyConditionAnnotation] = string(encoded)
+		_, err = s.core.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+
+	case *unstructured.Unstructured:
+		cond.ObservedGeneration = o.GetGeneration()
+		var conditions []metav1.Condition
+		if raw, found, _ := unstructured.NestedSlice(o.Object, "status", "conditions"); found {
+			for _, item := range raw {
+				var c metav1.Condition
+				if m, ok := item.(map[string]any); ok && runtime.DefaultUnstructuredConverter.FromUnstructured(m, &c) == nil {
+					conditions = append(conditions, c)
+				}
+			}
+		}
+		if !updateCondition(&conditions, cond) {
+			return
+		}
+		raw := make([]any, 0, len(conditions))
+		for i := range conditions {
+			m, convErr := runtime.DefaultUnstructuredConverter.ToUnstructured(&conditions[i])
+			if convErr != nil {
+				err = convErr
+				break
+			}
+			raw = append(raw, m)
+		}
+		if err == nil {
+			ap := o.DeepCopy()
+			if err = unstructured.SetNestedSlice(ap.Object, raw, "status", "conditions"); err == nil {
+				_, err = s.dynamic.Resource(AuthPolicyResource).Namespace(s.namespace).UpdateStatus(ctx, ap, metav1.UpdateOptions{})
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to write %s condition to %s: %v", PolicyConditionType, s.source(), err)
+	}
+}
+
+// updateCondition sets cond in conditions and reports whether anything other
+// than the transition time changed.
+func updateCondition(conditions *[]metav1.Condition, cond metav1.Condition) bool {
+	if existing := meta.FindStatusCondition(*conditions, cond.Type); existing != nil &&
+		existing.Status == cond.Status && existing.Reason == cond.Reason &&
+		existing.Message == cond.Message && existing.ObservedGeneration == cond.ObservedGeneration {
+		return false
+	}
+	return meta.SetStatusCondition(conditions, cond)
+}
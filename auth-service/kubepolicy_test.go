@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nkeys"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConfigMapPolicySource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nats", Name: "auth-policy"},
+		Data:       map[string]string{DefaultConfigMapKey: `{"scopes": {"nats:ops": {"sub_allow": ["ops.>"]}}}`},
+	}
+	client := fake.NewSimpleClientset(cm)
+	src := NewConfigMapPolicySource(client, "nats", "auth-policy", "", nil)
+
+	policy, err := src.Start(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := policy.Scopes["nats:ops"]; !ok || policy.Meta.Source != "configmap:nats/auth-policy" {
+		t.Fatalf("unexpected initial policy %v (%s)", policy.Scopes, policy.Meta)
+	}
+	policies := NewPolicyStore(policy)
+	src.OnChange(policies.SetActive)
+
+	condition := func() *metav1.Condition {
+		current, err := client.CoreV1().ConfigMaps("nats").Get(ctx, "auth-policy", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get configmap: %v", err)
+		}
+		raw, ok := current.Annotations[PolicyConditionAnnotation]
+		if !ok {
+			return nil
+		}
+		var c metav1.Condition
+		if err := json.Unmarshal([]byte(raw), &c); err != nil {
+			t.Fatalf("decode condition: %v", err)
+		}
+		return &c
+	}
+	update := func(doc string) {
+		current, err := client.CoreV1().ConfigMaps("nats").Get(ctx, "auth-policy", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get configmap: %v", err)
+		}
+		current.Data[DefaultConfigMapKey] = doc
+		if _, err := client.CoreV1().ConfigMaps("nats").Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("update configmap: %v", err)
+		}
+	}
+
+	// An invalid revision is reported on the ConfigMap and not activated.
+	update(`{"scopes": {}}`)
+	waitFor(t, "ValidationFailed condition", func() bool {
+		c := condition()
+		return c != nil && c.Status == metav1.ConditionFalse && c.Reason == "ValidationFailed"
+	})
+	if policies.Active() != policy {
+		t.Error("expected the previous policy to stay active")
+	}
+
+	update(`{"scopes": {"nats:ops": {"sub_allow": ["ops.eu.>"]}}}`)
+	waitFor(t, "new policy", func() bool {
+		return policies.Active().ResolvePermissions([]string{"nats:ops"}).SubAllow[0] == "ops.eu.>"
+	})
+	waitFor(t, "Valid condition", func() bool {
+		c := condition()
+		return c != nil && c.Status == metav1.ConditionTrue
+	})
+}
+
+func TestAuthPolicySource_Invalid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ap := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "natsauth.io/v1alpha1",
+		"kind":       "AuthPolicy",
+		"metadata":   map[string]any{"namespace": "nats", "name": "default", "generation": int64(3)},
+		"spec":       map[string]any{"scopes": map[string]any{}},
+	}}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{AuthPolicyResource: "AuthPolicyList"}, ap)
+	src := NewAuthPolicySource(client, "nats", "default", nil)
+
+	if _, err := src.Start(ctx); err == nil {
+		t.Fatal("expected an invalid AuthPolicy to fail startup")
+	}
+
+	current, err := client.Resource(AuthPolicyResource).Namespace("nats").Get(ctx, "default", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get authpolicy: %v", err)
+	}
+	conditions, _, _ := unstructured.NestedSlice(current.Object, "status", "conditions")
+	if len(conditions) != 1 {
+		t.Fatalf("expected one status condition, got %v", conditions)
+	}
+	c := conditions[0].(map[string]any)
+	if c["type"] != PolicyConditionType || c["status"] != "False" || c["observedGeneration"] != int64(3) {
+		t.Errorf("unexpected condition %v", c)
+	}
+}
+
+func TestConfigMapPolicySource_RejectsRollback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kp, _ := nkeys.CreateOperator()
+	pub, _ := kp.PublicKey()
+	trust, _ := ParsePolicyTrust(pub)
+	bundle := func(version uint64, subject string) string {
+		return string(signedBundle(t, kp, policyTarget, version, `{"scopes": {"nats:ops": {"sub_allow": ["`+subject+`"]}}}`))
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nats", Name: "auth-policy"},
+		Data:       map[string]string{DefaultConfigMapKey: bundle(2, "ops.>")},
+	}
+	client := fake.NewSimpleClientset(cm)
+	src := NewConfigMapPolicySource(client, "nats", "auth-policy", "", trust)
+	if _, err := src.Start(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	update := func(doc string) {
+		current, err := client.CoreV1().ConfigMaps("nats").Get(ctx, "auth-policy", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get configmap: %v", err)
+		}
+		current.Data[DefaultConfigMapKey] = doc
+		if _, err := client.CoreV1().ConfigMaps("nats").Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("update configmap: %v", err)
+		}
+	}
+	subject := func() string { return src.Current().ResolvePermissions([]string{"nats:ops"}).SubAllow[0] }
+
+	// An older bundle signed by the same key is not activated; a newer one is.
+	update(bundle(1, "ops.eu.>"))
+	update(bundle(3, "ops.us.>"))
+	waitFor(t, "version 3", func() bool { return src.Current().Meta.Version == 3 })
+	if subject() != "ops.us.>" {
+		t.Errorf("unexpected policy %s", subject())
+	}
+	update(bundle(2, "ops.>"))
+	time.Sleep(100 * time.Millisecond)
+	if v := src.Current().Meta.Version; v != 3 {
+		t.Errorf("expected version 3 to stay in effect, got %d", v)
+	}
+}
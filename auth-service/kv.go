@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// watchKV calls apply for every entry of kv. It returns once the initial
+// contents have been applied and keeps applying updates in the background
+// until ctx is cancelled.
+func watchKV(ctx context.Context, kv nats.KeyValue, apply func(nats.KeyValueEntry)) error {
+	w, err := kv.WatchAll(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	// The watcher delivers a nil entry once the initial values are replayed.
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		apply(entry)
+	}
+
+	go func() {
+		defer w.Stop()
+		for entry := range w.Updates() {
+			if entry != nil {
+				apply(entry)
+			}
+		}
+	}()
+	return nil
+}
+
+// encodeKeyParts base64url-encodes each part and joins them with ".", so
+// arbitrary issuers and subjects form a valid NATS KV key.
+func encodeKeyParts(parts ...string) string {
+	encoded := make([]string, len(parts))
+	for i, p := range parts {
+		encoded[i] = base64.RawURLEncoding.EncodeToString([]byte(p))
+	}
+	return strings.Join(encoded, ".")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestEncodeKeyParts(t *testing.T) {
+	key := encodeKeyParts("https://issuer.example.com", "svc.orders")
+	if key != "aHR0cHM6Ly9pc3N1ZXIuZXhhbXBsZS5jb20.c3ZjLm9yZGVycw" {
+		t.Errorf("unexpected key %q", key)
+	}
+	if OverrideKey("https://issuer.example.com", "svc.orders") != key {
+		t.Error("expected override keys to use the shared encoding")
+	}
+	if RevocationKey("https://issuer.example.com", RevokeSubject, "svc.orders") != "sub."+key {
+		t.Error("expected revocation keys to use the shared encoding")
+	}
+}
+
+func TestWatchKV(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, js := runJetStream(t)
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "watch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Put("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(chan string, 4)
+	if err := watchKV(ctx, kv, func(entry nats.KeyValueEntry) {
+		seen <- entry.Key() + "=" + string(entry.Value())
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The initial contents are applied before watchKV returns.
+	select {
+	case got := <-seen:
+		if got != "a=1" {
+			t.Fatalf("unexpected initial entry %s", got)
+		}
+	default:
+		t.Fatal("expected the initial entry to be applied before returning")
+	}
+
+	if _, err := kv.Put("b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "update to be applied", func() bool { return len(seen) == 1 })
+	if got := <-seen; got != "b=2" {
+		t.Errorf("unexpected update %s", got)
+	}
+}
@@ -6,26 +6,70 @@ import (
 	"crypto/x509"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 )
 
+// commands are offline tools run as "auth-service <command> [flags]".
+var commands = map[string]func(args []string) int{
+	"entitlements":    runEntitlements,
+	"fallback-config": runFallbackConfig,
+	"import-config":   runImportConfig,
+	"replay":          runReplay,
+	"sign-policy":     runSignPolicy,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	natsURL := envOrDefault("NATS_URL", "tls://nats:4222")
 	authUser := envOrDefault("NATS_USER", "auth-service")
 	authPass := envOrDefault("NATS_PASSWORD", "callout-secret")
 	seedFile := envOrDefault("NKEY_SEED_FILE", "/nkeys/auth.seed")
-	issuerURLs := mustEnv("OIDC_ISSUER_URL")
+	issuerURLs := os.Getenv("OIDC_ISSUER_URL")
+	issuersFile := os.Getenv("OIDC_ISSUERS_FILE")
 	oidcAudience := os.Getenv("OIDC_AUDIENCE")
 	tlsCAFile := os.Getenv("TLS_CA_FILE")
 	tlsServerName := os.Getenv("TLS_SERVER_NAME")
+	policyFile := os.Getenv("POLICY_FILE")
+	policyConfigMap := os.Getenv("POLICY_CONFIGMAP")
+	policyConfigMapKey := os.Getenv("POLICY_CONFIGMAP_KEY")
+	policyResource := os.Getenv("POLICY_RESOURCE")
+	candidatePolicyFile := os.Getenv("CANDIDATE_POLICY_FILE")
+	policyTrustedKeys := os.Getenv("POLICY_TRUSTED_KEYS")
+	fragmentTrustedKeys := os.Getenv("POLICY_FRAGMENT_TRUSTED_KEYS")
+	metricsAddr := os.Getenv("METRICS_ADDR")
+	overridesFile := os.Getenv("OVERRIDES_FILE")
+	overridesBucket := os.Getenv("OVERRIDES_KV_BUCKET")
+	fragmentsBucket := os.Getenv("POLICY_FRAGMENTS_KV_BUCKET")
+	replayBucket := os.Getenv("REPLAY_KV_BUCKET")
+	revocationsBucket := os.Getenv("REVOCATIONS_KV_BUCKET")
+	grantsBucket := os.Getenv("GRANTS_KV_BUCKET")
+	grantMaxDuration, err := time.ParseDuration(envOrDefault("GRANT_MAX_DURATION", "8h"))
+	if err != nil {
+		log.Fatalf("Invalid GRANT_MAX_DURATION: %v", err)
+	}
+	tokenCacheTTL, err := time.ParseDuration(envOrDefault("TOKEN_CACHE_TTL", "5m"))
+	if err != nil {
+		log.Fatalf("Invalid TOKEN_CACHE_TTL: %v", err)
+	}
+	introspectionCacheTTL, err := time.ParseDuration(envOrDefault("TOKEN_CACHE_INTROSPECTION_TTL", "0"))
+	if err != nil {
+		log.Fatalf("Invalid TOKEN_CACHE_INTROSPECTION_TTL: %v", err)
+	}
 
 	// Load account signing key
 	seedBytes, err := os.ReadFile(seedFile)
@@ -39,27 +83,99 @@ func main() {
 	pubKey, _ := signingKey.PublicKey()
 	log.Printf("Loaded signing key: %s", pubKey)
 
-	// Initialize OIDC verifiers (multi-issuer)
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+	// Load authorization policy, requiring signed bundles when trusted keys are configured
+	var trust *PolicyTrust
+	if policyTrustedKeys != "" {
+		trust, err = ParsePolicyTrust(policyTrustedKeys)
+		if err != nil {
+			log.Fatalf("Invalid POLICY_TRUSTED_KEYS: %v", err)
+		}
+		log.Printf("Policy signatures required (%d trusted keys)", len(trust.keys))
+	}
+	// Fragments are trusted separately, so a tenant's signing key cannot sign a base policy
+	var fragmentTrust *PolicyTrust
+	switch {
+	case fragmentTrustedKeys != "":
+		fragmentTrust, err = ParsePolicyTrust(fragmentTrustedKeys)
+		if err != nil {
+			log.Fatalf("Invalid POLICY_FRAGMENT_TRUSTED_KEYS: %v", err)
+		}
+		log.Printf("Fragment signatures required (%d trusted keys)", len(fragmentTrust.keys))
+	case trust != nil && fragmentsBucket != "":
+		log.Fatal("POLICY_FRAGMENT_TRUSTED_KEYS is required with POLICY_TRUSTED_KEYS and POLICY_FRAGMENTS_KV_BUCKET")
+	}
+	// Background watchers run until shutdown
+	runCtx, stopWatchers := context.WithCancel(context.Background())
+	defer stopWatchers()
+
+	policy := DefaultPolicy()
+	var kubePolicy *KubePolicySource
+	switch {
+	case policyConfigMap != "" || policyResource != "":
+		kubePolicy, err = newKubePolicySource(policyConfigMap, policyConfigMapKey, policyResource, trust)
+		if err != nil {
+			log.Fatalf("Failed to configure Kubernetes policy source: %v", err)
+		}
+		policy, err = kubePolicy.Start(runCtx)
+		if err != nil {
+			log.Fatalf("Failed to load policy: %v", err)
+		}
+		log.Printf("Watching policy in %s", kubePolicy.source())
+	case policyFile != "":
+		policy, err = LoadPolicy(policyFile, trust)
+		if err != nil {
+			log.Fatalf("Failed to load policy: %v", err)
+		}
+		log.Printf("Loaded policy (%d scopes): %s", len(policy.Scopes), policy.Meta)
+	}
+	log.Printf("Guardrails: deny pub=%v sub=%v", policy.Guardrails.Pub, policy.Guardrails.Sub)
+	policies := NewPolicyStore(policy)
 
-	var verifiers []*OIDCVerifier
-	for _, issuerURL := range strings.Split(issuerURLs, ",") {
-		issuerURL = strings.TrimSpace(issuerURL)
-		if issuerURL == "" {
-			continue
+	var candidate *Policy
+	if candidatePolicyFile != "" {
+		candidate, err = LoadPolicy(candidatePolicyFile, trust)
+		if err != nil {
+			log.Fatalf("Failed to load candidate policy: %v", err)
 		}
-		log.Printf("Initializing OIDC verifier for issuer: %s", issuerURL)
-		v, err := NewOIDCVerifier(ctx, issuerURL, oidcAudience)
+		policies.SetCandidate(candidate)
+		log.Printf("Shadow-evaluating candidate policy (%d scopes): %s", len(candidate.Scopes), candidate.Meta)
+	}
+
+	metrics := NewMetrics()
+	if metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics)
+			log.Printf("Serving metrics on %s/metrics", metricsAddr)
+			if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+				log.Printf("Metrics server stopped: %v", err)
+			}
+		}()
+	}
+
+	// Initialize OIDC verifiers (multi-issuer). Issuers whose discovery fails
+	// stay pending and are retried in the background.
+	staticIssuers := ParseIssuerURLs(issuerURLs, oidcAudience)
+	issuers := staticIssuers
+	if issuersFile != "" {
+		fileIssuers, err := LoadIssuersFile(issuersFile)
 		if err != nil {
-			log.Printf("WARNING: Failed to initialize OIDC verifier for %s: %v (will skip)", issuerURL, err)
-			continue
+			log.Fatalf("Failed to load issuers: %v", err)
 		}
-		verifiers = append(verifiers, v)
-		log.Printf("OIDC verifier ready for: %s", issuerURL)
+		issuers = append(append([]IssuerConfig{}, staticIssuers...), fileIssuers...)
+	}
+	if len(issuers) == 0 {
+		log.Fatal("No OIDC issuers configured: set OIDC_ISSUER_URL or OIDC_ISSUERS_FILE")
+	}
+	verifierSet := NewVerifierSet()
+	if tokenCacheTTL > 0 {
+		verifierSet.SetCache(NewTokenCache(tokenCacheTTL, introspectionCacheTTL, metrics))
+		log.Printf("Caching token validations for up to %s", tokenCacheTTL)
 	}
-	if len(verifiers) == 0 {
-		log.Fatal("No OIDC verifiers could be initialized")
+	verifierSet.Sync(runCtx, issuers)
+	if issuersFile != "" {
+		go verifierSet.WatchIssuersFile(runCtx, issuersFile, staticIssuers, 5*time.Second)
+		log.Printf("Watching issuers file %s", issuersFile)
 	}
 
 	// Connect to NATS as auth-service user
@@ -92,11 +208,115 @@ func main() {
 	defer nc.Close()
 	log.Printf("Connected to NATS at %s", natsURL)
 
+	bindKV := func(bucket string) nats.KeyValue {
+		js, err := nc.JetStream()
+		if err != nil {
+			log.Fatalf("Failed to get JetStream context: %v", err)
+		}
+		kv, err := js.KeyValue(bucket)
+		if err != nil {
+			log.Fatalf("Failed to bind KV bucket %s: %v", bucket, err)
+		}
+		return kv
+	}
+
+	// Merge tenant-owned policy fragments into the active policy
+	if fragmentsBucket != "" {
+		fragments := NewFragmentLoader(policy, policies, fragmentTrust)
+		if candidate != nil {
+			fragments.SetCandidate(candidate)
+		}
+		if err := fragments.Watch(runCtx, bindKV(fragmentsBucket)); err != nil {
+			log.Fatalf("Failed to load policy fragments: %v", err)
+		}
+		log.Printf("Watching tenant policy fragments in KV bucket %s (tenants loaded: %v)", fragmentsBucket, fragments.Tenants())
+		if kubePolicy != nil {
+			kubePolicy.OnChange(fragments.SetBase)
+		}
+	} else if kubePolicy != nil {
+		kubePolicy.OnChange(policies.SetActive)
+	}
+
+	// Load per-identity overrides
+	var overrides *OverrideStore
+	switch {
+	case overridesBucket != "":
+		kv := bindKV(overridesBucket)
+		overrides = NewOverrideStore()
+		if err := overrides.WatchOverridesKV(runCtx, kv); err != nil {
+			log.Fatalf("Failed to load overrides: %v", err)
+		}
+		log.Printf("Watching overrides in KV bucket %s", overridesBucket)
+	case overridesFile != "":
+		overrides = NewOverrideStore()
+		if err := overrides.LoadOverridesFile(overridesFile); err != nil {
+			log.Fatalf("Failed to load overrides: %v", err)
+		}
+		go overrides.WatchOverridesFile(runCtx, overridesFile, 5*time.Second)
+		log.Printf("Watching overrides file %s", overridesFile)
+	}
+
+	// Record used tokens of issuers with replay protection
+	if replayBucket != "" {
+		verifierSet.SetReplayStore(NewKVReplayStore(bindKV(replayBucket)))
+		log.Printf("Recording used token IDs in KV bucket %s", replayBucket)
+	} else {
+		verifierSet.SetReplayStore(NewMemoryReplayStore())
+		for _, cfg := range issuers {
+			if cfg.ReplayProtection {
+				log.Printf("Replay protection for %s records used token IDs in memory: each replica accepts a token once, so set REPLAY_KV_BUCKET when running more than one", cfg.URL)
+			}
+		}
+	}
+
 	// Create audit publisher
 	audit := NewAuditPublisher(nc)
 
+	// Mirror the revocation list and serve its admin API
+	var revocations *RevocationList
+	if revocationsBucket != "" {
+		kv := bindKV(revocationsBucket)
+		revocations = NewRevocationList()
+		if err := revocations.WatchKV(runCtx, kv); err != nil {
+			log.Fatalf("Failed to load revocations: %v", err)
+		}
+		if err := ServeRevocationAdmin(runCtx, nc, kv, revocations, verifierSet, audit, RevocationAdminConfig{
+			AdminScope: envOrDefault("REVOCATION_ADMIN_SCOPE", DefaultRevocationAdminScope),
+		}); err != nil {
+			log.Fatalf("Failed to start revocation admin API: %v", err)
+		}
+		log.Printf("Watching revocations in KV bucket %s (%d entries)", revocationsBucket, len(revocations.List()))
+	}
+
+	// Mirror elevation grants and serve their admin API
+	var grants *GrantStore
+	if grantsBucket != "" {
+		kv := bindKV(grantsBucket)
+		grants = NewGrantStore()
+		if err := grants.WatchKV(runCtx, kv); err != nil {
+			log.Fatalf("Failed to load grants: %v", err)
+		}
+		if err := ServeGrantAdmin(runCtx, nc, kv, grants, verifierSet, revocations, audit, GrantAdminConfig{
+			MaxDuration:   grantMaxDuration,
+			ApproverScope: envOrDefault("GRANT_APPROVER_SCOPE", DefaultGrantApproverScope),
+		}); err != nil {
+			log.Fatalf("Failed to start grant admin API: %v", err)
+		}
+		log.Printf("Watching grants in KV bucket %s (%d entries)", grantsBucket, len(grants.List()))
+	}
+
 	// Build authorizer function
-	authorizerFn := NewAuthorizer(verifiers, signingKey, pubKey, audit)
+	authorizerFn := NewAuthorizer(AuthorizerConfig{
+		Verifiers:    verifierSet,
+		Policies:     policies,
+		Overrides:    overrides,
+		Grants:       grants,
+		Revocations:  revocations,
+		SigningKey:   signingKey,
+		IssuerPubKey: pubKey,
+		Audit:        audit,
+		Metrics:      metrics,
+	})
 
 	// Subscribe to auth callout requests
 	sub, err := nc.Subscribe("$SYS.REQ.USER.AUTH", func(msg *nats.Msg) {
@@ -173,17 +393,41 @@ func respondWithError(msg *nats.Msg, signingKey nkeys.KeyPair, issuerPubKey, use
 	}
 }
 
+// newKubePolicySource builds the policy source for a "namespace/name"
+// ConfigMap or AuthPolicy reference.
+func newKubePolicySource(configMap, key, resource string, trust *PolicyTrust) (*KubePolicySource, error) {
+	if configMap != "" && resource != "" {
+		return nil, fmt.Errorf("set only one of POLICY_CONFIGMAP and POLICY_RESOURCE")
+	}
+	cfg, err := KubeClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if resource != "" {
+		namespace, name, err := ParseObjectRef(resource)
+		if err != nil {
+			return nil, err
+		}
+		client, err := dynamic.NewForConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewAuthPolicySource(client, namespace, name, trust), nil
+	}
+	namespace, name, err := ParseObjectRef(configMap)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewConfigMapPolicySource(client, namespace, name, key, trust), nil
+}
+
 func envOrDefault(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
 	}
 	return def
 }
-
-func mustEnv(key string) string {
-	v := os.Getenv(key)
-	if v == "" {
-		log.Fatalf("Required environment variable %s is not set", key)
-	}
-	return v
-}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics is a minimal counter registry exposed in the Prometheus text format.
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]map[string]uint64 // name -> rendered labels -> value
+}
+
+// NewMetrics creates an empty registry.
+func NewMetrics() *Metrics {
+	return &Metrics{counters: make(map[string]map[string]uint64)}
+}
+
+// Inc increments a counter. Labels are given as alternating name/value pairs.
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Add increments a counter by n. Labels are given as alternating name/value pairs.
+func (m *Metrics) Add(name string, n uint64, labels ...string) {
+	if m == nil {
+		return
+	}
+	key := renderLabels(labels)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.counters[name]
+	if !ok {
+		series = make(map[string]uint64)
+		m.counters[name] = series
+	}
+	series[key] += n
+}
+
+// Value returns the current value of a counter.
+func (m *Metrics) Value(name string, labels ...string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name][renderLabels(labels)]
+}
+
+// ServeHTTP writes all counters in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		series := m.counters[name]
+		keys := make([]string, 0, len(series))
+		for k := range series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s %d\n", name, k, series[k])
+		}
+	}
+}
+
+func renderLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -2,67 +2,123 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 )
 
-// OIDCVerifier wraps the go-oidc verifier with issuer metadata.
+// OIDCVerifier wraps the go-oidc verifier with issuer metadata. The
+// issuer's audience, algorithm and time settings are checked by Verify
+// itself so each rejection gets its own reason; go-oidc checks the
+// signature.
 type OIDCVerifier struct {
 	verifier  *oidc.IDTokenVerifier
 	provider  *oidc.Provider
 	issuerURL string
+	config    IssuerConfig
+	keys      *staticKeySet // nil when keys come from discovery
 }
 
 // OIDCClaims represents the claims extracted from a validated OIDC token.
 type OIDCClaims struct {
+	Issuer   string   `json:"iss"`
 	Subject  string   `json:"sub"`
 	Email    string   `json:"email"`
 	Scope    string   `json:"scope"`
 	Scopes   []string `json:"-"`
 	ClientID string   `json:"client_id"`
-}
+	JWTID    string   `json:"jti"`
+	ACR      string   `json:"acr"`
+	AMR      []string `json:"amr"`
 
-// NewOIDCVerifier creates a verifier with retry logic for startup ordering.
-func NewOIDCVerifier(ctx context.Context, issuerURL, audience string) (*OIDCVerifier, error) {
-	var provider *oidc.Provider
-	var err error
+	// Expiry and IssuedAt are the token's exp and iat claims; IssuedAt is
+	// zero when the token has none.
+	Expiry   time.Time `json:"-"`
+	IssuedAt time.Time `json:"-"`
+}
 
-	for i := 0; i < 15; i++ {
-		provider, err = oidc.NewProvider(ctx, issuerURL)
-		if err == nil {
-			break
-		}
-		log.Printf("OIDC provider not ready at %s (attempt %d/15): %v", issuerURL, i+1, err)
-		time.Sleep(2 * time.Second)
+// NewOIDCVerifier discovers the issuer's provider metadata and builds a
+// verifier. It makes a single attempt; VerifierSet retries failed issuers
+// in the background. Issuers configured with static keys skip discovery.
+func NewOIDCVerifier(ctx context.Context, cfg IssuerConfig) (*OIDCVerifier, error) {
+	if cfg.JWKSFile != "" || len(cfg.JWKS) > 0 {
+		return newStaticOIDCVerifier(cfg)
 	}
+
+	provider, err := oidc.NewProvider(ctx, cfg.URL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to discover OIDC provider at %s: %w", issuerURL, err)
+		return nil, fmt.Errorf("failed to discover OIDC provider at %s: %w", cfg.URL, err)
 	}
 
-	config := &oidc.Config{
-		SkipClientIDCheck: true,
+	return &OIDCVerifier{
+		verifier:  provider.Verifier(signatureConfig(cfg)),
+		provider:  provider,
+		issuerURL: cfg.URL,
+		config:    cfg,
+	}, nil
+}
+
+// newStaticOIDCVerifier builds a verifier from the issuer's configured keys
+// without contacting the issuer. Unless the issuer lists algorithms, any
+// asymmetric algorithm is accepted.
+func newStaticOIDCVerifier(cfg IssuerConfig) (*OIDCVerifier, error) {
+	keys, err := newStaticKeySet(cfg)
+	if err != nil {
+		return nil, err
 	}
-	if audience != "" {
-		config.SkipClientIDCheck = false
-		config.ClientID = audience
+	config := signatureConfig(cfg)
+	if len(config.SupportedSigningAlgs) == 0 {
+		for _, alg := range staticKeyAlgorithms {
+			config.SupportedSigningAlgs = append(config.SupportedSigningAlgs, string(alg))
+		}
 	}
-
 	return &OIDCVerifier{
-		verifier:  provider.Verifier(config),
-		provider:  provider,
-		issuerURL: issuerURL,
+		verifier:  oidc.NewVerifier(cfg.URL, keys, config),
+		issuerURL: cfg.URL,
+		config:    cfg,
+		keys:      keys,
 	}, nil
 }
 
+// Config returns the issuer configuration the verifier applies.
+func (v *OIDCVerifier) Config() IssuerConfig { return v.config }
+
+// signatureConfig configures go-oidc to check only the signature and issuer;
+// audience and time checks are done by Verify.
+func signatureConfig(cfg IssuerConfig) *oidc.Config {
+	return &oidc.Config{
+		SkipClientIDCheck:    true,
+		SkipExpiryCheck:      true,
+		SupportedSigningAlgs: cfg.Algorithms,
+	}
+}
+
 // Verify validates the token and extracts claims.
 func (v *OIDCVerifier) Verify(ctx context.Context, rawToken string) (*OIDCClaims, error) {
+	tok, err := peekToken(rawToken)
+	if err != nil {
+		return nil, err
+	}
+	if algs := v.config.Algorithms; len(algs) > 0 && !slices.Contains(algs, tok.Algorithm) {
+		return nil, fmt.Errorf("%w: %s not in %v", ErrAlgorithmNotAllowed, tok.Algorithm, algs)
+	}
+	if err := checkClaims(v.config, tok, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := checkProfile(v.config, tok); err != nil {
+		return nil, err
+	}
+
 	idToken, err := v.verifier.Verify(ctx, rawToken)
 	if err != nil {
-		return nil, fmt.Errorf("token verification failed: %w", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
 	}
 
 	var claims OIDCClaims
@@ -70,27 +126,373 @@ func (v *OIDCVerifier) Verify(ctx context.Context, rawToken string) (*OIDCClaims
 		return nil, fmt.Errorf("failed to parse token claims: %w", err)
 	}
 
-	if claims.Scope != "" {
-		claims.Scopes = strings.Split(claims.Scope, " ")
+	claims.Expiry, claims.IssuedAt = idToken.Expiry, idToken.IssuedAt
+	claims.normalize()
+	return &claims, nil
+}
+
+// normalize splits the scope claim and fills in the subject.
+func (c *OIDCClaims) normalize() {
+	if c.Scope != "" {
+		c.Scopes = strings.Split(c.Scope, " ")
 	}
 
 	// PingOne client_credentials tokens use client_id instead of sub
-	if claims.Subject == "" && claims.ClientID != "" {
-		claims.Subject = claims.ClientID
+	if c.Subject == "" && c.ClientID != "" {
+		c.Subject = c.ClientID
 	}
+}
 
-	return &claims, nil
+// checkClaims applies the issuer's audience and time settings to a token's
+// claims. For JWTs they are checked before the signature; rejecting on
+// unverified claims is safe since nothing is accepted until the signature
+// has been checked as well.
+func checkClaims(cfg IssuerConfig, tok *unverifiedToken, now time.Time) error {
+	if cfg.Audience != "" && !slices.Contains(tok.Audience, cfg.Audience) {
+		return fmt.Errorf("%w: expected %q, got %v", ErrAudienceMismatch, cfg.Audience, tok.Audience)
+	}
+
+	skew := cfg.ClockSkew.Duration()
+	if tok.Expiry == nil {
+		return fmt.Errorf("%w: no exp claim", ErrMalformedToken)
+	}
+	if exp := tok.Expiry.Time(); now.After(exp.Add(skew)) {
+		return fmt.Errorf("%w at %s", ErrTokenExpired, exp.UTC().Format(time.RFC3339))
+	}
+	// Without a configured skew, nbf keeps go-oidc's 5 minute tolerance.
+	nbfLeeway := skew
+	if cfg.ClockSkew == 0 {
+		nbfLeeway = 5 * time.Minute
+	}
+	if tok.NotBefore != nil && now.Add(nbfLeeway).Before(tok.NotBefore.Time()) {
+		return fmt.Errorf("%w until %s", ErrTokenNotYetValid, tok.NotBefore.Time().UTC().Format(time.RFC3339))
+	}
+	if maxAge := cfg.MaxTokenAge.Duration(); maxAge > 0 {
+		if tok.IssuedAt == nil {
+			return fmt.Errorf("%w: no iat claim", ErrTokenTooOld)
+		}
+		iat := tok.IssuedAt.Time()
+		if now.Add(skew).Before(iat) {
+			return fmt.Errorf("%w at %s", ErrTokenIssuedInFuture, iat.UTC().Format(time.RFC3339))
+		}
+		if age := now.Sub(iat); age > maxAge+skew {
+			return fmt.Errorf("%w: issued %s ago, max %s", ErrTokenTooOld, age.Round(time.Second), maxAge)
+		}
+	}
+	return nil
+}
+
+// checkProfile applies the issuer's token profile. The RFC 9068 profile
+// requires the at+jwt type and the claims an access token must carry; aud
+// and exp have already been checked by checkClaims.
+func checkProfile(cfg IssuerConfig, tok *unverifiedToken) error {
+	if cfg.RejectIDTokens && !tok.isAccessTokenType() {
+		for _, c := range []struct{ name, value string }{
+			{"nonce", tok.Nonce}, {"at_hash", tok.AtHash}, {"c_hash", tok.CHash}, {"s_hash", tok.SHash},
+			{"azp", tok.AuthorizedParty},
+		} {
+			if c.value != "" {
+				return fmt.Errorf("%w: token carries %s", ErrIDTokenRejected, c.name)
+			}
+		}
+		for _, aud := range tok.Audience {
+			if slices.Contains(cfg.IDTokenAudiences, aud) {
+				return fmt.Errorf("%w: token is addressed to login client %s", ErrIDTokenRejected, aud)
+			}
+		}
+	}
+	if cfg.Profile != ProfileAccessToken {
+		return nil
+	}
+	if !tok.isAccessTokenType() {
+		return fmt.Errorf("%w: typ %q, expected at+jwt", ErrInvalidTokenType, tok.Type)
+	}
+	for _, c := range []struct {
+		name    string
+		present bool
+	}{
+		{"sub", tok.Subject != ""},
+		{"client_id", tok.ClientID != ""},
+		{"iat", tok.IssuedAt != nil},
+		{"jti", tok.JWTID != ""},
+	} {
+		if !c.present {
+			return fmt.Errorf("%w: %s", ErrMissingClaim, c.name)
+		}
+	}
+	return nil
+}
+
+var (
+	// ErrUnknownIssuer is returned for tokens whose iss claim matches no
+	// configured issuer. Such tokens are rejected without verification.
+	ErrUnknownIssuer = errors.New("unknown issuer")
+
+	// ErrIssuerNotReady is returned for tokens of a configured issuer whose
+	// provider discovery has not succeeded yet.
+	ErrIssuerNotReady = errors.New("issuer not ready")
+
+	ErrMalformedToken      = errors.New("malformed token")
+	ErrAlgorithmNotAllowed = errors.New("signing algorithm not allowed")
+	ErrAudienceMismatch    = errors.New("audience mismatch")
+	ErrTokenExpired        = errors.New("token expired")
+	ErrTokenNotYetValid    = errors.New("token not yet valid")
+	ErrTokenIssuedInFuture = errors.New("token issued in the future")
+	ErrTokenTooOld         = errors.New("token too old")
+	ErrInvalidSignature    = errors.New("signature verification failed")
+	ErrTokenInactive       = errors.New("token is not active")
+	ErrInvalidTokenType    = errors.New("token type not accepted")
+	ErrMissingClaim        = errors.New("required claim missing")
+	ErrIDTokenRejected     = errors.New("ID token presented as credential")
+	ErrTokenReplayed       = errors.New("token already used")
+	ErrReplayCheck         = errors.New("replay check failed")
+	ErrIntrospection       = errors.New("token introspection failed")
+)
+
+// tokenFailureCodes maps validation errors to the reason codes recorded in
+// failure audit events.
+var tokenFailureCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrUnknownIssuer, "unknown_issuer"},
+	{ErrIssuerNotReady, "issuer_not_ready"},
+	{ErrMalformedToken, "malformed_token"},
+	{ErrAlgorithmNotAllowed, "algorithm_not_allowed"},
+	{ErrAudienceMismatch, "audience_mismatch"},
+	{ErrTokenExpired, "token_expired"},
+	{ErrTokenNotYetValid, "token_not_yet_valid"},
+	{ErrTokenIssuedInFuture, "token_issued_in_future"},
+	{ErrTokenTooOld, "token_too_old"},
+	{ErrInvalidSignature, "invalid_signature"},
+	{ErrTokenInactive, "token_inactive"},
+	{ErrInvalidTokenType, "invalid_token_type"},
+	{ErrMissingClaim, "missing_claim"},
+	{ErrIDTokenRejected, "id_token_rejected"},
+	{ErrTokenReplayed, "token_replayed"},
+	{ErrReplayCheck, "replay_check_failed"},
+	{ErrIntrospection, "introspection_failed"},
 }
 
-// ValidateToken tries each verifier in order, returning claims from the first success.
-func ValidateToken(ctx context.Context, rawToken string, verifiers []*OIDCVerifier) (*OIDCClaims, string, error) {
-	var lastErr error
-	for _, v := range verifiers {
-		claims, err := v.Verify(ctx, rawToken)
-		if err == nil {
-			return claims, v.issuerURL, nil
+// TokenError is a token validation failure, attributed to the issuer and
+// signing key named in the (unverified) token when they could be read.
+type TokenError struct {
+	Issuer string
+	KeyID  string
+	Err    error
+}
+
+// Code returns the failure's reason code, e.g. "token_expired", or
+// "invalid_token" when the error has no specific code.
+func (e *TokenError) Code() string {
+	for _, c := range tokenFailureCodes {
+		if errors.Is(e.Err, c.err) {
+			return c.code
+		}
+	}
+	return "invalid_token"
+}
+
+func (e *TokenError) Error() string {
+	if e.Issuer == "" {
+		return e.Err.Error()
+	}
+	prefix := "issuer " + e.Issuer
+	if e.KeyID != "" {
+		prefix += " (kid " + e.KeyID + ")"
+	}
+	return prefix + ": " + e.Err.Error()
+}
+
+func (e *TokenError) Unwrap() error { return e.Err }
+
+// unverifiedToken holds fields of a JWT read before its signature is
+// checked. They are only used to route the token and to reject it early.
+type unverifiedToken struct {
+	Issuer    string
+	KeyID     string
+	Algorithm string
+	Type      string
+	Subject   string
+	ClientID  string
+	JWTID     string
+	Audience  []string
+	Expiry    *numericDate
+	NotBefore *numericDate
+	IssuedAt  *numericDate
+
+	// ID token claims, used to tell ID tokens from access tokens.
+	Nonce           string
+	AtHash          string
+	CHash           string
+	SHash           string
+	AuthorizedParty string
+}
+
+// isAccessTokenType reports whether the typ header marks an RFC 9068
+// access token.
+func (t *unverifiedToken) isAccessTokenType() bool {
+	typ := strings.ToLower(t.Type)
+	return typ == "at+jwt" || typ == "application/at+jwt"
+}
+
+// numericDate is a JWT NumericDate: seconds since the epoch.
+type numericDate float64
+
+func (d numericDate) Time() time.Time {
+	sec, frac := math.Modf(float64(d))
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+// audience decodes an aud claim, which is either a string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("invalid aud claim: %w", err)
+	}
+	*a = list
+	return nil
+}
+
+// peekToken reads the header and registered claims of a compact JWT
+// without verifying it.
+func peekToken(rawToken string) (*unverifiedToken, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts, got %d", ErrMalformedToken, len(parts))
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+		Type      string `json:"typ"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrMalformedToken, err)
+	}
+	var payload struct {
+		Issuer    string       `json:"iss"`
+		Subject   string       `json:"sub"`
+		ClientID  string       `json:"client_id"`
+		JWTID     string       `json:"jti"`
+		Scope     any          `json:"scope"`
+		Audience  audience     `json:"aud"`
+		Expiry    *numericDate `json:"exp"`
+		NotBefore *numericDate `json:"nbf"`
+		IssuedAt  *numericDate `json:"iat"`
+		Nonce     string       `json:"nonce"`
+		AtHash    string       `json:"at_hash"`
+		CHash     string       `json:"c_hash"`
+		SHash     string       `json:"s_hash"`
+		Azp       string       `json:"azp"`
+	}
+	if err := decodeSegment(parts[1], &payload); err != nil {
+		return nil, fmt.Errorf("%w: payload: %v", ErrMalformedToken, err)
+	}
+	if payload.Issuer == "" {
+		return nil, fmt.Errorf("%w: no iss claim", ErrMalformedToken)
+	}
+	if _, ok := payload.Scope.(string); payload.Scope != nil && !ok {
+		return nil, fmt.Errorf("%w: scope must be a space-delimited string", ErrMalformedToken)
+	}
+	return &unverifiedToken{
+		Issuer:          payload.Issuer,
+		KeyID:           header.KeyID,
+		Algorithm:       header.Algorithm,
+		Type:            header.Type,
+		Subject:         payload.Subject,
+		ClientID:        payload.ClientID,
+		JWTID:           payload.JWTID,
+		Audience:        payload.Audience,
+		Expiry:          payload.Expiry,
+		NotBefore:       payload.NotBefore,
+		IssuedAt:        payload.IssuedAt,
+		Nonce:           payload.Nonce,
+		AtHash:          payload.AtHash,
+		CHash:           payload.CHash,
+		SHash:           payload.SHash,
+		AuthorizedParty: payload.Azp,
+	}, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ValidateToken verifies the token with the verifier of its issuer. Tokens
+// that are malformed, name an unknown issuer or an issuer whose discovery
+// has not yet succeeded fail without verification. Tokens that are not JWTs
+// go to the introspection issuer when exactly one is configured. Errors are
+// *TokenError values naming the issuer and key ID. When the set has a token
+// cache, successful results are served from it, after checking static key
+// files for rotation; the replay check runs on every call, cached or not.
+func ValidateToken(ctx context.Context, rawToken string, verifiers *VerifierSet) (*OIDCClaims, string, error) {
+	var claims *OIDCClaims
+	var issuer string
+	var err error
+	if cache := verifiers.tokenCache(); cache != nil {
+		verifiers.refreshKeys()
+		claims, issuer, err = cache.validate(ctx, rawToken, func() (*OIDCClaims, string, time.Time, error) {
+			return validateToken(ctx, rawToken, verifiers)
+		})
+	} else {
+		claims, issuer, _, err = validateToken(ctx, rawToken, verifiers)
+	}
+	if err != nil {
+		return nil, issuer, err
+	}
+	if err := verifiers.checkReplay(ctx, claims, issuer); err != nil {
+		return nil, issuer, &TokenError{Issuer: issuer, Err: err}
+	}
+	return claims, issuer, nil
+}
+
+// validateToken verifies the token and also returns how long the result may
+// be reused: until exp, or earlier when the issuer limits the token age.
+func validateToken(ctx context.Context, rawToken string, verifiers *VerifierSet) (*OIDCClaims, string, time.Time, error) {
+	var v TokenVerifier
+	tok, err := peekToken(rawToken)
+	if err != nil {
+		issuer, opaque, lookupErr := verifiers.lookupOpaque()
+		if opaque == nil && lookupErr == nil {
+			return nil, "", time.Time{}, &TokenError{Err: err}
+		}
+		if lookupErr != nil {
+			return nil, issuer, time.Time{}, &TokenError{Issuer: issuer, Err: lookupErr}
+		}
+		v, tok = opaque, &unverifiedToken{Issuer: issuer}
+	} else if v, err = verifiers.lookup(tok.Issuer); err != nil {
+		return nil, tok.Issuer, time.Time{}, &TokenError{Issuer: tok.Issuer, KeyID: tok.KeyID, Err: err}
+	}
+	start := time.Now()
+	claims, err := v.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, tok.Issuer, time.Time{}, &TokenError{Issuer: tok.Issuer, KeyID: tok.KeyID, Err: err}
+	}
+
+	cfg := v.Config()
+	validUntil := claims.Expiry
+	if maxAge := cfg.MaxTokenAge.Duration(); maxAge > 0 && !claims.IssuedAt.IsZero() {
+		if limit := claims.IssuedAt.Add(maxAge); limit.Before(validUntil) {
+			validUntil = limit
+		}
+	}
+	// Introspection results are reused only briefly, if at all, so a token
+	// revoked at the IdP stops being accepted.
+	if cache := verifiers.tokenCache(); cache != nil && cfg.Type == IssuerTypeIntrospection {
+		if limit := start.Add(cache.introspectionTTL); limit.Before(validUntil) {
+			validUntil = limit
 		}
-		lastErr = err
 	}
-	return nil, "", fmt.Errorf("token validation failed against all issuers: %w", lastErr)
+	return claims, cfg.URL, validUntil, nil
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+)
+
+// fakeIssuer signs tokens with an RSA key and builds verifiers that trust it
+// without discovery.
+type fakeIssuer struct {
+	url string
+	kid string
+	typ string
+	key *rsa.PrivateKey
+}
+
+func newFakeIssuer(t *testing.T, url string) *fakeIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return &fakeIssuer{url: url, kid: "key-1", typ: "JWT", key: key}
+}
+
+func (i *fakeIssuer) verifier() *OIDCVerifier {
+	return i.configured(IssuerConfig{URL: i.url})
+}
+
+// configured builds a verifier applying the issuer settings in cfg.
+func (i *fakeIssuer) configured(cfg IssuerConfig) *OIDCVerifier {
+	keys := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{i.key.Public()}}
+	return &OIDCVerifier{
+		verifier:  oidc.NewVerifier(i.url, keys, signatureConfig(cfg)),
+		issuerURL: i.url,
+		config:    cfg,
+	}
+}
+
+// sign issues a token for sub with the given scope, valid for ttl (negative
+// for an expired token). extra claims override the defaults; a nil value
+// removes the claim.
+func (i *fakeIssuer) sign(t *testing.T, sub, scope string, ttl time.Duration, extra map[string]any) string {
+	t.Helper()
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   i.url,
+		"sub":   sub,
+		"scope": scope,
+		"iat":   now.Add(-time.Minute).Unix(),
+		"exp":   now.Add(ttl).Unix(),
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: i.key},
+		(&jose.SignerOptions{}).WithType(jose.ContentType(i.typ)).WithHeader("kid", i.kid))
+	if err != nil {
+		t.Fatalf("new signer: %v", err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	return raw
+}
+
+func TestValidateToken_RoutesByIssuer(t *testing.T) {
+	ping := newFakeIssuer(t, "https://auth.pingone.example/as")
+	other := newFakeIssuer(t, "https://login.example.com")
+	verifiers := NewVerifierSet(ping.verifier(), other.verifier())
+
+	claims, issuer, err := ValidateToken(context.Background(), ping.sign(t, "svc", "nats:admin", time.Hour, nil), verifiers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if issuer != ping.url || claims.Subject != "svc" {
+		t.Errorf("expected svc from %s, got %s from %s", ping.url, claims.Subject, issuer)
+	}
+
+	// An expired token is attributed to its own issuer, not the last one tried.
+	_, _, err = ValidateToken(context.Background(), ping.sign(t, "svc", "nats:admin", -time.Minute, nil), verifiers)
+	var tokenErr *TokenError
+	if !errors.As(err, &tokenErr) || tokenErr.Issuer != ping.url || tokenErr.KeyID != "key-1" {
+		t.Fatalf("expected error attributed to %s, got %v", ping.url, err)
+	}
+	if !errors.Is(err, ErrTokenExpired) || tokenErr.Code() != "token_expired" {
+		t.Errorf("expected expiry to be reported, got %v", err)
+	}
+}
+
+func TestValidateToken_RejectsUnknownIssuer(t *testing.T) {
+	known := newFakeIssuer(t, "https://login.example.com")
+	unknown := newFakeIssuer(t, "https://evil.example.com")
+	verifiers := NewVerifierSet(known.verifier())
+
+	_, issuer, err := ValidateToken(context.Background(), unknown.sign(t, "svc", "nats:admin", time.Hour, nil), verifiers)
+	if !errors.Is(err, ErrUnknownIssuer) || issuer != unknown.url {
+		t.Errorf("expected unknown issuer error for %s, got %q %v", unknown.url, issuer, err)
+	}
+
+	for _, raw := range []string{"not-a-jwt", "a.b.c", strings.Repeat("x", 10) + ".e30.sig"} {
+		if _, _, err := ValidateToken(context.Background(), raw, verifiers); err == nil || errors.Is(err, ErrUnknownIssuer) {
+			t.Errorf("%q: expected malformed token error, got %v", raw, err)
+		}
+	}
+}
+
+func TestValidateToken_IssuerSettings(t *testing.T) {
+	iss := newFakeIssuer(t, "https://login.example.com")
+	verifiers := NewVerifierSet(iss.configured(IssuerConfig{
+		URL:         iss.url,
+		Audience:    "nats",
+		Algorithms:  []string{"RS256"},
+		ClockSkew:   Duration(30 * time.Second),
+		MaxTokenAge: Duration(time.Hour),
+	}))
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		extra map[string]any
+		code  string
+	}{
+		{"valid", time.Hour, map[string]any{"aud": "nats"}, ""},
+		{"audience list", time.Hour, map[string]any{"aud": []string{"other", "nats"}}, ""},
+		{"expired within skew", -10 * time.Second, map[string]any{"aud": "nats"}, ""},
+		{"wrong audience", time.Hour, map[string]any{"aud": "other"}, "audience_mismatch"},
+		{"no audience", time.Hour, nil, "audience_mismatch"},
+		{"expired", -time.Minute, map[string]any{"aud": "nats"}, "token_expired"},
+		{"not yet valid", time.Hour, map[string]any{"aud": "nats", "nbf": now.Add(time.Minute).Unix()}, "token_not_yet_valid"},
+		{"too old", time.Hour, map[string]any{"aud": "nats", "iat": now.Add(-2 * time.Hour).Unix()}, "token_too_old"},
+		{"no iat", time.Hour, map[string]any{"aud": "nats", "iat": nil}, "token_too_old"},
+		{"issued in future", time.Hour, map[string]any{"aud": "nats", "iat": now.Add(time.Minute).Unix()}, "token_issued_in_future"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := iss.sign(t, "svc", "nats:admin", tt.ttl, tt.extra)
+			_, _, err := ValidateToken(context.Background(), raw, verifiers)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var tokenErr *TokenError
+			if !errors.As(err, &tokenErr) || tokenErr.Code() != tt.code {
+				t.Errorf("expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestValidateToken_AlgorithmNotAllowed(t *testing.T) {
+	iss := newFakeIssuer(t, "https://login.example.com")
+	verifiers := NewVerifierSet(iss.configured(IssuerConfig{URL: iss.url, Algorithms: []string{"ES256"}}))
+
+	_, _, err := ValidateToken(context.Background(), iss.sign(t, "svc", "nats:admin", time.Hour, nil), verifiers)
+	var tokenErr *TokenError
+	if !errors.As(err, &tokenErr) || tokenErr.Code() != "algorithm_not_allowed" {
+		t.Errorf("expected algorithm_not_allowed, got %v", err)
+	}
+}
+
+func TestValidateToken_AccessTokenProfile(t *testing.T) {
+	iss := newFakeIssuer(t, "https://login.example.com")
+	cfg := IssuerConfig{URL: iss.url, Audience: "nats", Profile: ProfileAccessToken}
+	verifiers := NewVerifierSet(iss.configured(cfg))
+	valid := map[string]any{"aud": "nats", "client_id": "app", "jti": "t-1"}
+	with := func(k string, v any) map[string]any {
+		claims := map[string]any{}
+		for name, value := range valid {
+			claims[name] = value
+		}
+		claims[k] = v
+		return claims
+	}
+
+	tests := []struct {
+		name   string
+		typ    string
+		claims map[string]any
+		code   string
+	}{
+		{"access token", "at+jwt", valid, ""},
+		{"media type", "application/at+jwt", valid, ""},
+		{"id token", "JWT", valid, "invalid_token_type"},
+		{"no client_id", "at+jwt", with("client_id", nil), "missing_claim"},
+		{"no jti", "at+jwt", with("jti", nil), "missing_claim"},
+		{"no iat", "at+jwt", with("iat", nil), "missing_claim"},
+		{"no sub", "at+jwt", with("sub", nil), "missing_claim"},
+		{"wrong audience", "at+jwt", with("aud", "other"), "audience_mismatch"},
+		{"scope list", "at+jwt", with("scope", []string{"nats:admin"}), "malformed_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iss.typ = tt.typ
+			_, _, err := ValidateToken(context.Background(), iss.sign(t, "svc", "nats:admin", time.Hour, tt.claims), verifiers)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var tokenErr *TokenError
+			if !errors.As(err, &tokenErr) || tokenErr.Code() != tt.code {
+				t.Errorf("expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestValidateToken_RejectIDTokens(t *testing.T) {
+	iss := newFakeIssuer(t, "https://login.example.com")
+	verifiers := NewVerifierSet(iss.configured(IssuerConfig{
+		URL: iss.url, RejectIDTokens: true, IDTokenAudiences: []string{"web-login"},
+	}))
+
+	if _, _, err := ValidateToken(context.Background(), iss.sign(t, "svc", "nats:admin", time.Hour, map[string]any{"aud": "nats"}), verifiers); err != nil {
+		t.Fatalf("unexpected error for access token: %v", err)
+	}
+	for name, extra := range map[string]map[string]any{
+		"id token claims":  {"nonce": "n-1", "at_hash": "x"},
+		"azp":              {"azp": "web-login"},
+		"login client aud": {"aud": []string{"web-login"}},
+	} {
+		_, _, err := ValidateToken(context.Background(), iss.sign(t, "alice", "", time.Hour, extra), verifiers)
+		var tokenErr *TokenError
+		if !errors.As(err, &tokenErr) || tokenErr.Code() != "id_token_rejected" {
+			t.Errorf("%s: expected id_token_rejected, got %v", name, err)
+		}
+	}
+
+	if err := (IssuerConfig{URL: iss.url, IDTokenAudiences: []string{"web-login"}}).validate(); err == nil {
+		t.Error("expected id_token_audiences without reject_id_tokens to be refused")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Override adjusts the permissions of a single identity after policy
+// resolution, without changing the scopes issued by the IdP.
+type Override struct {
+	Issuer   string      `json:"issuer"`
+	Subject  string      `json:"subject"`
+	PubAllow []string    `json:"pub_allow,omitempty"`
+	SubAllow []string    `json:"sub_allow,omitempty"`
+	PubDeny  []string    `json:"pub_deny,omitempty"`
+	SubDeny  []string    `json:"sub_deny,omitempty"`
+	Limits   *UserLimits `json:"limits,omitempty"`
+	Disabled bool        `json:"disabled,omitempty"`
+	Reason   string      `json:"reason,omitempty"`
+}
+
+// OverrideKey returns the store key for an identity. Issuer and subject are
+// base64url-encoded so the key is valid as a NATS KV key.
+func OverrideKey(issuer, subject string) string {
+	return encodeKeyParts(issuer, subject)
+}
+
+// validate checks that the override names an identity.
+func (o *Override) validate() error {
+	if o.Issuer == "" || o.Subject == "" {
+		return fmt.Errorf("issuer and subject are required")
+	}
+	return nil
+}
+
+// OverrideStore holds per-identity overrides keyed by issuer and subject. It
+// is populated from a local file or a NATS KV bucket.
+type OverrideStore struct {
+	mu      sync.RWMutex
+	entries map[string]*Override
+}
+
+// NewOverrideStore creates an empty store.
+func NewOverrideStore() *OverrideStore {
+	return &OverrideStore{entries: make(map[string]*Override)}
+}
+
+// Lookup returns the override for an identity, or nil when there is none.
+// A nil store has no overrides.
+func (s *OverrideStore) Lookup(issuer, subject string) *Override {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.entries[OverrideKey(issuer, subject)]
+}
+
+// Replace swaps in a complete set of overrides.
+func (s *OverrideStore) Replace(overrides []*Override) {
+	entries := make(map[string]*Override, len(overrides))
+	for _, o := range overrides {
+		entries[OverrideKey(o.Issuer, o.Subject)] = o
+	}
+	s.mu.Lock()
+	s.entries = entries
+	s.mu.Unlock()
+}
+
+func (s *OverrideStore) put(key string, o *Override) {
+	s.mu.Lock()
+	s.entries[key] = o
+	s.mu.Unlock()
+}
+
+func (s *OverrideStore) delete(key string) {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+}
+
+// LoadOverridesFile reads a JSON array of overrides into the store.
+func (s *OverrideStore) LoadOverridesFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read overrides file %s: %w", path, err)
+	}
+	var overrides []*Override
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return fmt.Errorf("failed to parse overrides file %s: %w", path, err)
+	}
+	for i, o := range overrides {
+		if err := o.validate(); err != nil {
+			return fmt.Errorf("override %d in %s: %w", i, path, err)
+		}
+	}
+	s.Replace(overrides)
+	return nil
+}
+
+// WatchOverridesFile reloads the overrides file whenever its modification
+// time changes, until ctx is cancelled. A file that fails to load leaves the
+// previous overrides in place.
+func (s *OverrideStore) WatchOverridesFile(ctx context.Context, path string, interval time.Duration) {
+	var lastMod time.Time
+	if fi, err := os.Stat(path); err == nil {
+		lastMod = fi.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = fi.ModTime()
+		if err := s.LoadOverridesFile(path); err != nil {
+			log.Printf("Keeping previous overrides: %v", err)
+			continue
+		}
+		log.Printf("Reloaded overrides from %s", path)
+	}
+}
+
+// WatchOverridesKV mirrors a NATS KV bucket into the store. Keys must be
+// OverrideKey(issuer, subject); values are JSON overrides. It returns once the
+// initial contents have been loaded and keeps applying updates in the
+// background until ctx is cancelled.
+func (s *OverrideStore) WatchOverridesKV(ctx context.Context, kv nats.KeyValue) error {
+	apply := func(entry nats.KeyValueEntry) {
+		switch entry.Operation() {
+		case nats.KeyValueDelete, nats.KeyValuePurge:
+			s.delete(entry.Key())
+		default:
+			var o Override
+			if err := json.Unmarshal(entry.Value(), &o); err != nil {
+				log.Printf("Ignoring invalid override %s: %v", entry.Key(), err)
+				return
+			}
+			if err := o.validate(); err != nil {
+				log.Printf("Ignoring invalid override %s: %v", entry.Key(), err)
+				return
+			}
+			// An entry under another key would never be looked up.
+			if key := OverrideKey(o.Issuer, o.Subject); entry.Key() != key {
+				log.Printf("Ignoring override %s: key must be %s for issuer %s and subject %s", entry.Key(), key, o.Issuer, o.Subject)
+				return
+			}
+			s.put(entry.Key(), &o)
+		}
+	}
+
+	if err := watchKV(ctx, kv, apply); err != nil {
+		return fmt.Errorf("failed to watch overrides bucket %s: %w", kv.Bucket(), err)
+	}
+	return nil
+}
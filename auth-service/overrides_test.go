@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+const testIssuer = "https://issuer.example.com"
+
+func TestOverrideStore_LoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	doc := `[
+		{"issuer": "https://issuer.example.com", "subject": "alice", "pub_allow": ["orders.eu.>"]},
+		{"issuer": "https://issuer.example.com", "subject": "mallory", "disabled": true}
+	]`
+	if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewOverrideStore()
+	if err := store.LoadOverridesFile(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o := store.Lookup(testIssuer, "alice"); o == nil || !reflect.DeepEqual(o.PubAllow, []string{"orders.eu.>"}) {
+		t.Errorf("expected alice override, got %+v", o)
+	}
+	if o := store.Lookup("https://other.example.com", "alice"); o != nil {
+		t.Errorf("expected overrides to be scoped to the issuer, got %+v", o)
+	}
+	if o := (*OverrideStore)(nil).Lookup(testIssuer, "alice"); o != nil {
+		t.Errorf("expected nil store to have no overrides, got %+v", o)
+	}
+}
+
+func TestOverrideStore_RejectsIncompleteEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	if err := os.WriteFile(path, []byte(`[{"subject": "alice"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewOverrideStore().LoadOverridesFile(path); err == nil {
+		t.Error("expected error for override without issuer")
+	}
+}
+
+func TestOverrideStore_WatchKVRejectsInvalidEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, js := runJetStream(t)
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "auth-overrides"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, doc := range map[string]string{
+		OverrideKey(testIssuer, "alice"): `{"issuer": "` + testIssuer + `", "subject": "alice", "disabled": true}`,
+		OverrideKey(testIssuer, "bob"):   `{"subject": "bob", "disabled": true}`,
+		OverrideKey(testIssuer, "carol"): `{"issuer": "` + testIssuer + `", "subject": "dave", "disabled": true}`,
+	} {
+		if _, err := kv.Put(key, []byte(doc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewOverrideStore()
+	if err := store.WatchOverridesKV(ctx, kv); err != nil {
+		t.Fatal(err)
+	}
+	if store.Lookup(testIssuer, "alice") == nil {
+		t.Error("expected the valid override to be loaded")
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if len(store.entries) != 1 {
+		t.Errorf("expected entries without issuer or under a mismatched key to be ignored, got %d entries", len(store.entries))
+	}
+}
+
+func TestEvaluate_OverrideGrantsAndDenies(t *testing.T) {
+	claims := &OIDCClaims{Issuer: testIssuer, Subject: "alice", Scopes: []string{"nats:subscribe"}}
+	override := &Override{
+		PubAllow: []string{"orders.eu.>"},
+		SubDeny:  []string{"orders.us.>"},
+		Limits:   &UserLimits{Subs: 5},
+	}
+
+	d := DefaultPolicy().Evaluate(claims, override, nil)
+	if !d.Allowed || !d.OverrideApplied {
+		t.Fatalf("expected allowed decision with override applied, got %+v", d)
+	}
+	if !reflect.DeepEqual(d.Permissions.PubAllow, []string{"orders.eu.>"}) {
+		t.Errorf("expected added pub allow, got %v", d.Permissions.PubAllow)
+	}
+	if d.Permissions.SubDeny[len(d.Permissions.SubDeny)-1] != "orders.us.>" {
+		t.Errorf("expected added sub deny, got %v", d.Permissions.SubDeny)
+	}
+	if d.Limits.Subs != 5 {
+		t.Errorf("expected override limits, got %+v", d.Limits)
+	}
+
+	// The compiled policy must not see the override's additions.
+	if p := DefaultPolicy().ResolvePermissions(claims.Scopes); len(p.PubAllow) != 0 {
+		t.Errorf("expected override not to leak into the policy, got %v", p.PubAllow)
+	}
+}
+
+func TestEvaluate_OverrideGrantsWithoutScopes(t *testing.T) {
+	claims := &OIDCClaims{Issuer: testIssuer, Subject: "oncall", Scopes: []string{"openid"}}
+	d := DefaultPolicy().Evaluate(claims, &Override{SubAllow: []string{"events.>"}}, nil)
+	if !d.Allowed {
+		t.Errorf("expected override grant to allow the identity, got %+v", d)
+	}
+}
+
+func TestEvaluate_OverrideDisabled(t *testing.T) {
+	claims := &OIDCClaims{Issuer: testIssuer, Subject: "mallory", Scopes: []string{"nats:admin"}}
+	d := DefaultPolicy().Evaluate(claims, &Override{Disabled: true, Reason: "compromised laptop"}, nil)
+	if d.Allowed {
+		t.Fatal("expected disabled identity to be denied")
+	}
+	if !d.OverrideApplied || !strings.Contains(d.Reason, "compromised laptop") {
+		t.Errorf("expected override reason, got %+v", d)
+	}
+}
@@ -1,9 +1,23 @@
 package main
 
+import "sync"
+
 // ScopeMapping defines NATS permissions granted by an OIDC scope.
 type ScopeMapping struct {
-	PubAllow []string
-	SubAllow []string
+	PubAllow []string `json:"pub_allow,omitempty"`
+	SubAllow []string `json:"sub_allow,omitempty"`
+
+	// PubDeny and SubDeny are denied to any identity holding the scope, even
+	// when another scope allows them.
+	PubDeny []string `json:"pub_deny,omitempty"`
+	SubDeny []string `json:"sub_deny,omitempty"`
+
+	// Privileged mappings may grant guardrail subjects by naming them exactly.
+	Privileged bool `json:"privileged,omitempty"`
+
+	// Assurance, when set, is the authentication assurance (MFA, acr level)
+	// a token must show to hold the scope.
+	Assurance *AssuranceRequirement `json:"assurance,omitempty"`
 }
 
 // DefaultScopeMappings maps OIDC scopes to NATS pub/sub permissions.
@@ -25,35 +39,39 @@ var DefaultScopeMappings = map[string]ScopeMapping{
 type ResolvedPermissions struct {
 	PubAllow []string
 	SubAllow []string
+	PubDeny  []string
+	SubDeny  []string
 }
 
-// ResolvePermissions merges all scope mappings for the given scopes.
+// defaultPolicy is the built-in policy, compiled once for ResolvePermissions.
+var defaultPolicy = sync.OnceValue(DefaultPolicy)
+
+// ResolvePermissions merges all scope mappings for the given scopes using the default policy.
 func ResolvePermissions(scopes []string) *ResolvedPermissions {
-	seen := make(map[string]bool)
-	result := &ResolvedPermissions{}
-
-	for _, scope := range scopes {
-		mapping, ok := DefaultScopeMappings[scope]
-		if !ok {
-			continue
-		}
-		for _, s := range mapping.PubAllow {
-			key := "pub:" + s
-			if !seen[key] {
-				result.PubAllow = append(result.PubAllow, s)
-				seen[key] = true
-			}
-		}
-		for _, s := range mapping.SubAllow {
-			key := "sub:" + s
-			if !seen[key] {
-				result.SubAllow = append(result.SubAllow, s)
-				seen[key] = true
-			}
-		}
-	}
+	return defaultPolicy().ResolvePermissions(scopes)
+}
+
+// ResolvePermissions merges all scope mappings for the given scopes and
+// denies every guardrail subject not explicitly granted by a privileged
+// mapping, plus the denies of each matched mapping.
+func (p *Policy) ResolvePermissions(scopes []string) *ResolvedPermissions {
+	return p.compiled().resolve(p, scopes)
+}
 
-	return result
+// grammarMapping builds a mapping for a parameterized scope. Grammar scopes
+// are never privileged, so guardrails always apply to them.
+func (p *Policy) grammarMapping(scope string) (ScopeMapping, bool) {
+	if p.ScopeGrammar == nil {
+		return ScopeMapping{}, false
+	}
+	verb, subject, ok := p.ScopeGrammar.ParseScope(scope)
+	if !ok {
+		return ScopeMapping{}, false
+	}
+	if verb == "pub" {
+		return ScopeMapping{PubAllow: []string{subject}}, true
+	}
+	return ScopeMapping{SubAllow: []string{subject}}, true
 }
 
 // HasPermissions returns true if any permissions were resolved.
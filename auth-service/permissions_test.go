@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
+	"slices"
 	"sort"
 	"testing"
 )
@@ -71,3 +73,254 @@ func TestResolvePermissions_Empty(t *testing.T) {
 		t.Error("expected no permissions for nil scopes")
 	}
 }
+
+func TestResolvePermissions_GuardrailsDenied(t *testing.T) {
+	p := ResolvePermissions([]string{"nats:admin"})
+	expectedPub := []string{"$SYS.>", "$JS.API.>", "auth.audit.>"}
+	if !reflect.DeepEqual(p.PubDeny, expectedPub) {
+		t.Errorf("expected pub deny %v, got %v", expectedPub, p.PubDeny)
+	}
+	expectedSub := []string{"$SYS.>", "$JS.API.>"}
+	if !reflect.DeepEqual(p.SubDeny, expectedSub) {
+		t.Errorf("expected sub deny %v, got %v", expectedSub, p.SubDeny)
+	}
+}
+
+func TestResolvePermissions_GuardrailsAlwaysApplied(t *testing.T) {
+	p := ResolvePermissions([]string{"openid"})
+	if len(p.PubDeny) == 0 || len(p.SubDeny) == 0 {
+		t.Errorf("expected guardrail denies without grants, got pub=%v sub=%v", p.PubDeny, p.SubDeny)
+	}
+}
+
+func TestResolvePermissions_PrivilegedExemption(t *testing.T) {
+	policy := &Policy{
+		Scopes: map[string]ScopeMapping{
+			"nats:sys": {
+				SubAllow:   []string{"$SYS.>"},
+				Privileged: true,
+			},
+			"nats:sys-unprivileged": {
+				PubAllow: []string{"$SYS.>"},
+			},
+		},
+		Guardrails: &DefaultGuardrails,
+	}
+
+	p := policy.ResolvePermissions([]string{"nats:sys"})
+	if !reflect.DeepEqual(p.SubDeny, []string{"$JS.API.>"}) {
+		t.Errorf("expected privileged sub grant to lift only its guardrail, got deny %v", p.SubDeny)
+	}
+	if !reflect.DeepEqual(p.PubDeny, DefaultGuardrails.Pub) {
+		t.Errorf("expected pub guardrails to remain, got %v", p.PubDeny)
+	}
+
+	p = policy.ResolvePermissions([]string{"nats:sys-unprivileged"})
+	if !slices.Contains(p.PubDeny, "$SYS.>") {
+		t.Errorf("expected unprivileged grant to stay denied, got %v", p.PubDeny)
+	}
+}
+
+func TestResolvePermissions_ScopeDenies(t *testing.T) {
+	policy := &Policy{
+		Scopes: map[string]ScopeMapping{
+			"nats:orders": {
+				PubAllow: []string{"orders.>"},
+				PubDeny:  []string{"orders.admin.>"},
+			},
+			"nats:admin": {
+				PubAllow: []string{">"},
+			},
+		},
+		Guardrails: &DefaultGuardrails,
+	}
+
+	p := policy.ResolvePermissions([]string{"nats:orders", "nats:admin"})
+	expected := append(append([]string{}, DefaultGuardrails.Pub...), "orders.admin.>")
+	if !reflect.DeepEqual(p.PubDeny, expected) {
+		t.Errorf("expected scope deny after guardrails %v, got %v", expected, p.PubDeny)
+	}
+
+	p = policy.ResolvePermissions([]string{"nats:admin"})
+	if !reflect.DeepEqual(p.PubDeny, DefaultGuardrails.Pub) {
+		t.Errorf("expected only guardrails without the denying scope, got %v", p.PubDeny)
+	}
+}
+
+func TestParsePolicy_DefaultGuardrails(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{"scopes": {"nats:admin": {"pub_allow": [">"]}}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(*policy.Guardrails, DefaultGuardrails) {
+		t.Errorf("expected default guardrails, got %+v", policy.Guardrails)
+	}
+
+	// An empty section cannot disable the defaults.
+	policy, err = ParsePolicy([]byte(`{"scopes": {"nats:admin": {"pub_allow": [">"], "sub_allow": [">"]}}, "guardrails": {}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p := policy.ResolvePermissions([]string{"nats:admin"}); !slices.Contains(p.PubDeny, "$SYS.>") || !slices.Contains(p.SubDeny, "$SYS.>") {
+		t.Errorf("expected empty guardrails section to keep $SYS.> denied, got pub=%v sub=%v", p.PubDeny, p.SubDeny)
+	}
+
+	// A policy may add guardrails.
+	policy, err = ParsePolicy([]byte(`{"scopes": {"nats:admin": {"pub_allow": [">"]}}, "guardrails": {"pub": ["billing.>"]}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := append(slices.Clone(DefaultGuardrails.Pub), "billing.>")
+	if p := policy.ResolvePermissions([]string{"nats:admin"}); !reflect.DeepEqual(p.PubDeny, expected) {
+		t.Errorf("expected %v, got %v", expected, p.PubDeny)
+	}
+}
+
+func TestResolvePermissions_ScopeGrammar(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{
+		"scope_grammar": {"prefix": "nats", "allowed_prefixes": ["orders", "events"]}
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p := policy.ResolvePermissions([]string{"nats:pub:orders", "nats:sub:events.eu", "openid"})
+	if !reflect.DeepEqual(p.PubAllow, []string{"orders.>"}) {
+		t.Errorf("expected pub [orders.>], got %v", p.PubAllow)
+	}
+	if !reflect.DeepEqual(p.SubAllow, []string{"events.eu.>"}) {
+		t.Errorf("expected sub [events.eu.>], got %v", p.SubAllow)
+	}
+}
+
+func TestResolvePermissions_ScopeGrammarRejected(t *testing.T) {
+	policy := &Policy{
+		ScopeGrammar: &ScopeGrammar{Prefix: "nats", AllowedPrefixes: []string{"orders"}},
+	}
+	for _, scope := range []string{
+		"nats:pub:payments",   // not on allow-list
+		"nats:pub:ordersx",    // shares a string prefix only
+		"nats:pub:orders.>",   // wildcard
+		"nats:pub:orders.*.x", // wildcard token
+		"nats:pub:orders..eu", // empty token
+		"nats:del:orders",     // unknown verb
+		"other:pub:orders",    // wrong grammar prefix
+		"nats:pub:",
+	} {
+		if p := policy.ResolvePermissions([]string{scope}); p.HasPermissions() {
+			t.Errorf("expected %q to grant nothing, got pub=%v sub=%v", scope, p.PubAllow, p.SubAllow)
+		}
+	}
+}
+
+func TestParsePolicy_InvalidScopeGrammar(t *testing.T) {
+	for _, doc := range []string{
+		`{"scope_grammar": {"prefix": "", "allowed_prefixes": ["orders"]}}`,
+		`{"scope_grammar": {"prefix": "nats", "allowed_prefixes": ["orders.>"]}}`,
+	} {
+		if _, err := ParsePolicy([]byte(doc)); err == nil {
+			t.Errorf("expected error for %s", doc)
+		}
+	}
+}
+
+func TestNarrowInboxes(t *testing.T) {
+	p := ResolvePermissions([]string{"nats:subscribe"})
+	prefix := InboxPrefix("https://issuer.example.com", "alice")
+	p.NarrowInboxes(prefix)
+
+	sort.Strings(p.SubAllow)
+	expected := []string{prefix + ".>", "events.>", "orders.>"}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(p.SubAllow, expected) {
+		t.Errorf("expected sub %v, got %v", expected, p.SubAllow)
+	}
+}
+
+func TestInboxPrefix_PerIdentity(t *testing.T) {
+	alice := InboxPrefix("https://issuer.example.com", "alice")
+	if alice != InboxPrefix("https://issuer.example.com", "alice") {
+		t.Error("expected inbox prefix to be deterministic")
+	}
+	if alice == InboxPrefix("https://issuer.example.com", "bob") {
+		t.Error("expected different subjects to get different inboxes")
+	}
+	if alice == InboxPrefix("https://other.example.com", "alice") {
+		t.Error("expected different issuers to get different inboxes")
+	}
+	if !isLiteralSubject(alice) {
+		t.Errorf("expected literal inbox prefix, got %q", alice)
+	}
+}
+
+func TestResolvePermissions_DoesNotMutateIndex(t *testing.T) {
+	policy := DefaultPolicy()
+	p := policy.ResolvePermissions([]string{"nats:subscribe"})
+	p.NarrowInboxes("_INBOX.private")
+
+	again := policy.ResolvePermissions([]string{"nats:subscribe"})
+	sort.Strings(again.SubAllow)
+	expected := []string{"_INBOX.>", "events.>", "orders.>"}
+	if !reflect.DeepEqual(again.SubAllow, expected) {
+		t.Errorf("expected compiled rule to be unchanged %v, got %v", expected, again.SubAllow)
+	}
+}
+
+// benchmarkPolicy builds a policy with n tenant roles, each granting its own
+// subject space plus shared inbox and event subjects.
+func benchmarkPolicy(n int) *Policy {
+	scopes := make(map[string]ScopeMapping, n)
+	for i := 0; i < n; i++ {
+		scopes[fmt.Sprintf("tenant-%d:role-%d", i%50, i)] = ScopeMapping{
+			PubAllow: []string{fmt.Sprintf("tenants.%d.role%d.>", i%50, i), "events.>"},
+			SubAllow: []string{fmt.Sprintf("tenants.%d.>", i%50), "_INBOX.>"},
+		}
+	}
+	return &Policy{Scopes: scopes, Account: DefaultAccount, Guardrails: &DefaultGuardrails}
+}
+
+func BenchmarkEvaluate(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		policy := benchmarkPolicy(n)
+		claims := &OIDCClaims{
+			Issuer:  "https://issuer.example.com",
+			Subject: "svc",
+			Scopes: []string{
+				"openid",
+				fmt.Sprintf("tenant-%d:role-%d", (n/2)%50, n/2),
+				fmt.Sprintf("tenant-%d:role-%d", (n-1)%50, n-1),
+			},
+		}
+		policy.compiled()
+
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if d := policy.Evaluate(claims, nil, nil); !d.Allowed {
+					b.Fatal("expected allowed decision")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompilePolicy(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		policy := benchmarkPolicy(n)
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				compilePolicy(policy)
+			}
+		})
+	}
+}
+
+func TestResolvePermissions_DefaultPolicyCompiledOnce(t *testing.T) {
+	ResolvePermissions([]string{"nats:admin"})
+	idx := defaultPolicy().index
+	ResolvePermissions([]string{"nats:publish"})
+	if idx == nil || defaultPolicy().index != idx {
+		t.Error("expected the default policy index to be reused")
+	}
+}
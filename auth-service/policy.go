@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAccount is the account authenticated users are placed in.
+const DefaultAccount = "APP"
+
+// Guardrails lists reserved subjects that are denied to every identity unless
+// a privileged scope mapping grants the exact subject in the same direction.
+type Guardrails struct {
+	Pub []string `json:"pub"`
+	Sub []string `json:"sub"`
+}
+
+// withDefaults returns DefaultGuardrails extended by g. A policy can add
+// guardrails but never remove the defaults.
+func (g *Guardrails) withDefaults() Guardrails {
+	merged := Guardrails{
+		Pub: slices.Clone(DefaultGuardrails.Pub),
+		Sub: slices.Clone(DefaultGuardrails.Sub),
+	}
+	if g != nil {
+		merged.Pub = appendNew(merged.Pub, g.Pub)
+		merged.Sub = appendNew(merged.Sub, g.Sub)
+	}
+	return merged
+}
+
+// DefaultGuardrails protects the system account, the JetStream API and the
+// auth service's audit subjects. Audit subjects stay subscribable so the
+// dashboard can follow decisions; publishing to them would forge events.
+var DefaultGuardrails = Guardrails{
+	Pub: []string{"$SYS.>", "$JS.API.>", "auth.audit.>"},
+	Sub: []string{"$SYS.>", "$JS.API.>"},
+}
+
+// Policy is the authorization policy applied to validated tokens.
+type Policy struct {
+	Scopes map[string]ScopeMapping `json:"scopes"`
+
+	// Account is the target account for issued user JWTs. Defaults to DefaultAccount.
+	Account string `json:"account,omitempty"`
+
+	// Limits applied to every issued user JWT. Server defaults apply when nil.
+	Limits *UserLimits `json:"limits,omitempty"`
+
+	// Guardrails always includes DefaultGuardrails; the policy file may
+	// only add subjects to them.
+	Guardrails *Guardrails `json:"guardrails,omitempty"`
+
+	// SharedInboxes keeps "_INBOX.>" grants as written instead of narrowing
+	// them to a private per-identity inbox prefix.
+	SharedInboxes bool `json:"shared_inboxes,omitempty"`
+
+	// ScopeGrammar enables parameterized scopes. Disabled when nil.
+	ScopeGrammar *ScopeGrammar `json:"scope_grammar,omitempty"`
+
+	// ACRLevels orders acr values from weakest to strongest, for scopes
+	// whose assurance requirement names a min_acr.
+	ACRLevels []string `json:"acr_levels,omitempty"`
+
+	// Tenants declares the tenants allowed to manage their own policy
+	// fragments, keyed by tenant name.
+	Tenants map[string]TenantConfig `json:"tenants,omitempty"`
+
+	// Meta records the policy's source, digest and signature check.
+	Meta PolicyMeta `json:"-"`
+
+	indexOnce sync.Once
+	index     *policyIndex
+}
+
+// ScopeGrammar describes parameterized scopes of the form
+// "<prefix>:<verb>:<subject-prefix>", e.g. "nats:pub:orders" or
+// "nats:sub:events.eu". The verb is "pub" or "sub" and the scope grants
+// "<subject-prefix>.>" when the subject prefix is on the allow-list.
+type ScopeGrammar struct {
+	Prefix          string   `json:"prefix"`
+	AllowedPrefixes []string `json:"allowed_prefixes"`
+}
+
+// UserLimits are the connection limits written into issued user JWTs.
+// Zero fields are left at the NATS default (unlimited).
+type UserLimits struct {
+	Subs    int64 `json:"subs,omitempty"`
+	Payload int64 `json:"payload,omitempty"`
+	Data    int64 `json:"data,omitempty"`
+}
+
+// DefaultPolicy returns the built-in policy used when no policy file is configured.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Scopes:     DefaultScopeMappings,
+		Account:    DefaultAccount,
+		Guardrails: &DefaultGuardrails,
+		Meta:       PolicyMeta{Source: "built-in"},
+	}
+}
+
+// LoadPolicy reads a JSON policy file, which may be a signed bundle. With a
+// non-nil trust set, only bundles signed by a trusted key are accepted.
+func LoadPolicy(path string, trust *PolicyTrust) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", path, err)
+	}
+	doc, meta, err := OpenPolicyDocument(data, path, trust, BundleTarget{Kind: BundlePolicy})
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePolicy(doc)
+	if err != nil {
+		return nil, err
+	}
+	p.Meta = meta
+	return p, nil
+}
+
+// ParsePolicy decodes and validates a JSON policy document.
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	if len(p.Scopes) == 0 && p.ScopeGrammar == nil {
+		return nil, fmt.Errorf("policy defines no scopes")
+	}
+	if p.Account == "" {
+		p.Account = DefaultAccount
+	}
+	guardrails := p.Guardrails.withDefaults()
+	p.Guardrails = &guardrails
+	if g := p.ScopeGrammar; g != nil {
+		if g.Prefix == "" || strings.Contains(g.Prefix, ":") {
+			return nil, fmt.Errorf("scope_grammar: invalid prefix %q", g.Prefix)
+		}
+		for _, prefix := range g.AllowedPrefixes {
+			if !isLiteralSubject(prefix) {
+				return nil, fmt.Errorf("scope_grammar: allowed prefix %q must be a literal subject", prefix)
+			}
+		}
+	}
+	for _, scope := range sortedKeys(p.Scopes) {
+		if a := p.Scopes[scope].Assurance; a != nil {
+			if err := p.validateAssurance(scope, a); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for tenant, cfg := range p.Tenants {
+		if tenant == "" || strings.ContainsAny(tenant, ":.*> \t") {
+			return nil, fmt.Errorf("tenants: invalid tenant name %q", tenant)
+		}
+		if !isLiteralSubject(cfg.Prefix) {
+			return nil, fmt.Errorf("tenants: %s prefix %q must be a literal subject", tenant, cfg.Prefix)
+		}
+	}
+	p.compiled()
+	return &p, nil
+}
+
+// withScopes returns a copy of the policy with a different scope set. The
+// copy is compiled independently of p.
+func (p *Policy) withScopes(scopes map[string]ScopeMapping) *Policy {
+	return &Policy{
+		Scopes:        scopes,
+		Account:       p.Account,
+		Limits:        p.Limits,
+		Guardrails:    p.Guardrails,
+		SharedInboxes: p.SharedInboxes,
+		ScopeGrammar:  p.ScopeGrammar,
+		ACRLevels:     p.ACRLevels,
+		Tenants:       p.Tenants,
+		Meta:          p.Meta,
+	}
+}
+
+// compiled returns the policy's index, building it on first use. Policies
+// must not be modified once they have been used to resolve permissions.
+func (p *Policy) compiled() *policyIndex {
+	p.indexOnce.Do(func() {
+		p.index = compilePolicy(p)
+	})
+	return p.index
+}
+
+// ParseScope interprets a parameterized scope. It returns the verb ("pub" or
+// "sub") and the granted subject, and ok=false when the scope does not follow
+// the grammar or names a subject prefix that is not on the allow-list.
+func (g *ScopeGrammar) ParseScope(scope string) (verb, subject string, ok bool) {
+	parts := strings.SplitN(scope, ":", 3)
+	if len(parts) != 3 || parts[0] != g.Prefix {
+		return "", "", false
+	}
+	verb, prefix := parts[1], parts[2]
+	if verb != "pub" && verb != "sub" {
+		return "", "", false
+	}
+	if !isLiteralSubject(prefix) || !g.allows(prefix) {
+		return "", "", false
+	}
+	return verb, prefix + ".>", true
+}
+
+func (g *ScopeGrammar) allows(prefix string) bool {
+	for _, allowed := range g.AllowedPrefixes {
+		if prefix == allowed || strings.HasPrefix(prefix, allowed+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// isLiteralSubject reports whether s is a non-empty NATS subject without wildcards.
+func isLiteralSubject(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, token := range strings.Split(s, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// Decision is the outcome of evaluating a policy for a validated token.
+type Decision struct {
+	Allowed         bool
+	Reason          string
+	ReasonCode      string // set when the decision has a machine-readable cause
+	Account         string
+	Permissions     *ResolvedPermissions
+	Limits          *UserLimits
+	OverrideApplied bool
+
+	// Grants lists the IDs of elevation grants merged into the permissions,
+	// and Expires is the earliest of their end times (zero without grants).
+	Grants  []string
+	Expires time.Time
+
+	// Assurance records the token's acr/amr and any scopes downgraded
+	// because they fell short of a requirement.
+	Assurance *AssuranceObservation
+}
+
+// Evaluate resolves the permissions granted to a validated token, after
+// scope assurance requirements have denied the token or downgraded the
+// scopes it fails. A non-nil override for the identity is applied on top
+// of the resolved permissions, followed by any active elevation grants.
+func (p *Policy) Evaluate(claims *OIDCClaims, override *Override, grants []*Grant) *Decision {
+	scopes, assurance, err := p.applyAssurance(claims)
+	if err != nil {
+		return &Decision{
+			Reason:      err.Error(),
+			ReasonCode:  "assurance_required",
+			Account:     p.Account,
+			Permissions: &ResolvedPermissions{},
+			Assurance:   assurance,
+		}
+	}
+	perms := p.ResolvePermissions(scopes)
+	d := &Decision{
+		Account:     p.Account,
+		Permissions: perms,
+		Limits:      p.Limits,
+		Assurance:   assurance,
+	}
+	if override != nil {
+		d.applyOverride(override)
+		if override.Disabled {
+			return d
+		}
+	}
+	for _, g := range grants {
+		d.applyGrant(g)
+	}
+	if !p.SharedInboxes {
+		perms.NarrowInboxes(InboxPrefix(claims.Issuer, claims.Subject))
+	}
+	d.Allowed = perms.HasPermissions()
+	if !d.Allowed {
+		d.Reason = "no authorized NATS scopes in token"
+	}
+	return d
+}
+
+func (d *Decision) applyGrant(g *Grant) {
+	d.Permissions.PubAllow = appendNew(d.Permissions.PubAllow, g.PubAllow)
+	d.Permissions.SubAllow = appendNew(d.Permissions.SubAllow, g.SubAllow)
+	d.Grants = append(d.Grants, g.ID)
+	if d.Expires.IsZero() || g.ExpiresAt.Before(d.Expires) {
+		d.Expires = g.ExpiresAt
+	}
+}
+
+func (d *Decision) applyOverride(o *Override) {
+	d.OverrideApplied = true
+	if o.Disabled {
+		d.Allowed = false
+		d.Reason = "identity disabled by override"
+		if o.Reason != "" {
+			d.Reason += ": " + o.Reason
+		}
+		return
+	}
+	perms := d.Permissions
+	perms.PubAllow = appendNew(perms.PubAllow, o.PubAllow)
+	perms.SubAllow = appendNew(perms.SubAllow, o.SubAllow)
+	perms.PubDeny = appendNew(perms.PubDeny, o.PubDeny)
+	perms.SubDeny = appendNew(perms.SubDeny, o.SubDeny)
+	if o.Limits != nil {
+		d.Limits = o.Limits
+	}
+}
+
+// PolicyStore holds the active policy and an optional candidate policy that
+// is evaluated in shadow mode but never enforced.
+type PolicyStore struct {
+	active    atomic.Pointer[Policy]
+	candidate atomic.Pointer[Policy]
+}
+
+// NewPolicyStore creates a store with the given active policy.
+func NewPolicyStore(active *Policy) *PolicyStore {
+	s := &PolicyStore{}
+	s.active.Store(active)
+	return s
+}
+
+// Active returns the enforced policy.
+func (s *PolicyStore) Active() *Policy {
+	return s.active.Load()
+}
+
+// Candidate returns the shadow policy, or nil when none is loaded.
+func (s *PolicyStore) Candidate() *Policy {
+	return s.candidate.Load()
+}
+
+// SetActive replaces the enforced policy.
+func (s *PolicyStore) SetActive(p *Policy) {
+	s.active.Store(p)
+}
+
+// SetCandidate replaces the shadow policy. Passing nil disables shadow evaluation.
+func (s *PolicyStore) SetCandidate(p *Policy) {
+	s.candidate.Store(p)
+}
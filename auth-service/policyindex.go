@@ -0,0 +1,154 @@
+package main
+
+import "slices"
+
+// policyIndex is the compiled form of a Policy. It is built once when the
+// policy loads so that resolving permissions on a callout is a map lookup per
+// scope plus a merge of pre-deduplicated subject sets.
+type policyIndex struct {
+	rules map[string]*compiledRule
+
+	// pubDeny and subDeny are the guardrail denies for identities without
+	// any privileged grant. They are clipped so appends never share storage.
+	pubDeny []string
+	subDeny []string
+}
+
+// compiledRule is a scope mapping with deduplicated subjects. liftPub and
+// liftSub mark, per guardrail index, the guardrails a privileged rule lifts.
+type compiledRule struct {
+	pub     []string
+	sub     []string
+	pubDeny []string
+	subDeny []string
+	liftPub []bool
+	liftSub []bool
+}
+
+// compilePolicy builds the index for p.
+func compilePolicy(p *Policy) *policyIndex {
+	idx := &policyIndex{rules: make(map[string]*compiledRule, len(p.Scopes))}
+	guardrails := p.Guardrails.withDefaults()
+	idx.pubDeny = slices.Clip(slices.Clone(guardrails.Pub))
+	idx.subDeny = slices.Clip(slices.Clone(guardrails.Sub))
+
+	for scope, mapping := range p.Scopes {
+		idx.rules[scope] = compileRule(mapping, guardrails)
+	}
+	return idx
+}
+
+func compileRule(m ScopeMapping, guardrails Guardrails) *compiledRule {
+	r := &compiledRule{
+		pub:     dedupSubjects(m.PubAllow),
+		sub:     dedupSubjects(m.SubAllow),
+		pubDeny: dedupSubjects(m.PubDeny),
+		subDeny: dedupSubjects(m.SubDeny),
+	}
+	if m.Privileged {
+		r.liftPub = liftedGuardrails(guardrails.Pub, r.pub)
+		r.liftSub = liftedGuardrails(guardrails.Sub, r.sub)
+	}
+	return r
+}
+
+// liftedGuardrails marks the guardrails granted by name in subjects, or
+// returns nil when none are.
+func liftedGuardrails(guardrails, subjects []string) []bool {
+	var lifted []bool
+	for i, g := range guardrails {
+		if slices.Contains(subjects, g) {
+			if lifted == nil {
+				lifted = make([]bool, len(guardrails))
+			}
+			lifted[i] = true
+		}
+	}
+	return lifted
+}
+
+func dedupSubjects(subjects []string) []string {
+	out := make([]string, 0, len(subjects))
+	for _, s := range subjects {
+		if !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	return slices.Clip(out)
+}
+
+// resolve merges the compiled rules matched by scopes.
+func (idx *policyIndex) resolve(p *Policy, scopes []string) *ResolvedPermissions {
+	var buf [8]*compiledRule
+	matched := buf[:0]
+	for _, scope := range scopes {
+		if r, ok := idx.rules[scope]; ok {
+			matched = append(matched, r)
+			continue
+		}
+		if mapping, ok := p.grammarMapping(scope); ok {
+			matched = append(matched, &compiledRule{pub: mapping.PubAllow, sub: mapping.SubAllow})
+		}
+	}
+
+	result := &ResolvedPermissions{}
+	switch len(matched) {
+	case 0:
+	case 1:
+		// SubAllow is cloned because inbox narrowing rewrites it in place.
+		result.PubAllow = slices.Clip(matched[0].pub)
+		result.SubAllow = slices.Clone(matched[0].sub)
+	default:
+		for _, r := range matched {
+			result.PubAllow = appendNew(result.PubAllow, r.pub)
+			result.SubAllow = appendNew(result.SubAllow, r.sub)
+		}
+	}
+
+	result.PubDeny = applyLifts(idx.pubDeny, matched, func(r *compiledRule) []bool { return r.liftPub })
+	result.SubDeny = applyLifts(idx.subDeny, matched, func(r *compiledRule) []bool { return r.liftSub })
+	// Guardrail slices are clipped, so appending rule denies copies them.
+	for _, r := range matched {
+		result.PubDeny = appendNew(result.PubDeny, r.pubDeny)
+		result.SubDeny = appendNew(result.SubDeny, r.subDeny)
+	}
+	return result
+}
+
+// appendNew appends the subjects from src that dst does not already contain.
+func appendNew(dst, src []string) []string {
+	for _, s := range src {
+		if !slices.Contains(dst, s) {
+			dst = append(dst, s)
+		}
+	}
+	return dst
+}
+
+// applyLifts removes guardrails lifted by any matched privileged rule. The
+// shared deny slice is returned unchanged when nothing is lifted.
+func applyLifts(deny []string, matched []*compiledRule, lifts func(*compiledRule) []bool) []string {
+	var lifted []bool
+	for _, r := range matched {
+		l := lifts(r)
+		if l == nil {
+			continue
+		}
+		if lifted == nil {
+			lifted = make([]bool, len(deny))
+		}
+		for i, ok := range l {
+			lifted[i] = lifted[i] || ok
+		}
+	}
+	if lifted == nil {
+		return deny
+	}
+	var out []string
+	for i, s := range deny {
+		if !lifted[i] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
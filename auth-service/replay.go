@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ReplayReport summarizes the impact of a proposed policy on recorded logins.
+type ReplayReport struct {
+	Events     int               `json:"events"`
+	Replayed   int               `json:"replayed"`
+	Skipped    int               `json:"skipped"`
+	Excluded   int               `json:"excluded"`
+	Identities []*IdentityImpact `json:"identities"`
+}
+
+// IdentityImpact describes how a proposed policy changes one identity's access.
+type IdentityImpact struct {
+	Issuer      string        `json:"issuer"`
+	Subject     string        `json:"subject"`
+	Logins      int           `json:"logins"`
+	AllowToDeny int           `json:"allow_to_deny,omitempty"`
+	DenyToAllow int           `json:"deny_to_allow,omitempty"`
+	Gained      *GrantedPerms `json:"gained,omitempty"`
+	Lost        *GrantedPerms `json:"lost,omitempty"`
+}
+
+// Changed reports whether the proposed policy affects this identity at all.
+func (i *IdentityImpact) Changed() bool {
+	return i.AllowToDeny > 0 || i.DenyToAllow > 0 || i.Gained != nil || i.Lost != nil
+}
+
+// ReplayEvents re-resolves recorded audit events under policy, narrowed by
+// each event's recorded downscope request. Events without a validated token
+// (no subject, e.g. signature failures) cannot be replayed and are counted as
+// skipped. Events whose outcome depended on state outside the policy —
+// overrides, elevation grants, revocations — are counted as excluded.
+func ReplayEvents(r io.Reader, policy *Policy) (*ReplayReport, error) {
+	report := &ReplayReport{}
+	impacts := make(map[string]*IdentityImpact)
+
+	dec := json.NewDecoder(r)
+	for {
+		var event AuditEvent
+		err := dec.Decode(&event)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode audit event %d: %w", report.Events+1, err)
+		}
+		report.Events++
+
+		if event.TokenSub == "" || (event.Decision != "success" && event.Decision != "failure") {
+			report.Skipped++
+			continue
+		}
+		if !policyDecided(&event) {
+			report.Excluded++
+			continue
+		}
+		report.Replayed++
+
+		key := event.TokenIssuer + "\x00" + event.TokenSub
+		impact, ok := impacts[key]
+		if !ok {
+			impact = &IdentityImpact{Issuer: event.TokenIssuer, Subject: event.TokenSub}
+			impacts[key] = impact
+		}
+		impact.Logins++
+
+		claims := &OIDCClaims{
+			Issuer:  event.TokenIssuer,
+			Subject: event.TokenSub,
+			Scopes:  event.Requested.FilterScopes(event.Scopes),
+		}
+		if event.Assurance != nil {
+			claims.ACR, claims.AMR = event.Assurance.ACR, event.Assurance.AMR
+		}
+		decision := policy.Evaluate(claims, nil, nil)
+		event.Requested.Apply(decision, InboxPrefix(event.TokenIssuer, event.TokenSub)+".>")
+		recordedAllowed := event.Decision == "success"
+		switch {
+		case recordedAllowed && !decision.Allowed:
+			impact.AllowToDeny++
+		case !recordedAllowed && decision.Allowed:
+			impact.DenyToAllow++
+		}
+
+		recorded := event.Permissions
+		if recorded == nil {
+			recorded = &GrantedPerms{}
+		}
+		proposed := &GrantedPerms{}
+		if decision.Allowed {
+			proposed = NewGrantedPerms(decision.Permissions)
+		}
+		impact.Gained = mergeGrantedPerms(impact.Gained, subtractGrantedPerms(proposed, recorded))
+		impact.Lost = mergeGrantedPerms(impact.Lost, subtractGrantedPerms(recorded, proposed))
+	}
+
+	for _, impact := range impacts {
+		report.Identities = append(report.Identities, impact)
+	}
+	sort.Slice(report.Identities, func(i, j int) bool {
+		a, b := report.Identities[i], report.Identities[j]
+		if a.Issuer != b.Issuer {
+			return a.Issuer < b.Issuer
+		}
+		return a.Subject < b.Subject
+	})
+	return report, nil
+}
+
+// policyDecided reports whether a recorded outcome follows from the policy
+// and the token alone, so that replaying it under another policy is a fair
+// comparison. Reason codes mark denials made before the policy was consulted,
+// except assurance denials, which the policy made from the recorded acr/amr.
+func policyDecided(event *AuditEvent) bool {
+	if event.OverrideApplied || len(event.Grants) > 0 {
+		return false
+	}
+	return event.ReasonCode == "" || event.ReasonCode == "assurance_required"
+}
+
+// subtractGrantedPerms returns the subjects in a that are not in b, or nil when there are none.
+func subtractGrantedPerms(a, b *GrantedPerms) *GrantedPerms {
+	d := &GrantedPerms{
+		PubAllow: subtractSubjects(a.PubAllow, b.PubAllow),
+		SubAllow: subtractSubjects(a.SubAllow, b.SubAllow),
+		PubDeny:  subtractSubjects(a.PubDeny, b.PubDeny),
+		SubDeny:  subtractSubjects(a.SubDeny, b.SubDeny),
+	}
+	if len(d.PubAllow)+len(d.SubAllow)+len(d.PubDeny)+len(d.SubDeny) == 0 {
+		return nil
+	}
+	return d
+}
+
+// mergeGrantedPerms returns the union of a and b, either of which may be nil.
+func mergeGrantedPerms(a, b *GrantedPerms) *GrantedPerms {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return &GrantedPerms{
+		PubAllow: append(a.PubAllow, subtractSubjects(b.PubAllow, a.PubAllow)...),
+		SubAllow: append(a.SubAllow, subtractSubjects(b.SubAllow, a.SubAllow)...),
+		PubDeny:  append(a.PubDeny, subtractSubjects(b.PubDeny, a.PubDeny)...),
+		SubDeny:  append(a.SubDeny, subtractSubjects(b.SubDeny, a.SubDeny)...),
+	}
+}
+
+func subtractSubjects(a, b []string) []string {
+	exclude := make(map[string]bool, len(b))
+	for _, s := range b {
+		exclude[s] = true
+	}
+	var out []string
+	for _, s := range a {
+		if !exclude[s] {
+			out = append(out, s)
+			exclude[s] = true
+		}
+	}
+	return out
+}
+
+// runReplay implements the "replay" command.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	policyFile := fs.String("policy", "", "Proposed policy file (required)")
+	eventsFile := fs.String("events", "-", "Audit events as JSON lines; \"-\" reads stdin")
+	format := fs.String("format", "text", "Output format: text|json")
+	showAll := fs.Bool("all", false, "Include identities whose access does not change")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: auth-service replay -policy <file> [-events <file>] [-format text|json]")
+		fmt.Fprintln(fs.Output(), "Re-resolves recorded auth.audit events under a proposed policy.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *policyFile == "" {
+		fs.Usage()
+		return 2
+	}
+
+	policy, err := LoadPolicy(*policyFile, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	in := io.Reader(os.Stdin)
+	if *eventsFile != "-" {
+		f, err := os.Open(*eventsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open events file: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	report, err := ReplayEvents(in, policy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !*showAll {
+		changed := report.Identities[:0]
+		for _, impact := range report.Identities {
+			if impact.Changed() {
+				changed = append(changed, impact)
+			}
+		}
+		report.Identities = changed
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "text":
+		writeReplayText(os.Stdout, report)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+	return 0
+}
+
+func writeReplayText(w io.Writer, report *ReplayReport) {
+	fmt.Fprintf(w, "Events: %d  replayed: %d  skipped: %d  excluded: %d  identities affected: %d\n\n",
+		report.Events, report.Replayed, report.Skipped, report.Excluded, len(report.Identities))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ISSUER\tSUBJECT\tLOGINS\tALLOW->DENY\tDENY->ALLOW\tGAINED\tLOST")
+	for _, i := range report.Identities {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n",
+			i.Issuer, i.Subject, i.Logins, i.AllowToDeny, i.DenyToAllow,
+			formatGrantedPerms(i.Gained), formatGrantedPerms(i.Lost))
+	}
+	tw.Flush()
+}
+
+func formatGrantedPerms(p *GrantedPerms) string {
+	if p == nil {
+		return "-"
+	}
+	var parts []string
+	add := func(label string, subjects []string) {
+		if len(subjects) > 0 {
+			parts = append(parts, label+"="+strings.Join(subjects, ","))
+		}
+	}
+	add("pub", p.PubAllow)
+	add("sub", p.SubAllow)
+	add("deny_pub", p.PubDeny)
+	add("deny_sub", p.SubDeny)
+	return strings.Join(parts, " ")
+}
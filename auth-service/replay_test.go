@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplayEvents(t *testing.T) {
+	iss := "https://issuer.example.com"
+	inbox := InboxPrefix(iss, "reader") + ".>"
+	guardrails := `"pub_deny":["$SYS.>","$JS.API.>","auth.audit.>"],"sub_deny":["$SYS.>","$JS.API.>"]`
+	events := `
+{"decision":"success","token_issuer":"` + iss + `","token_sub":"writer","scopes":["nats:publish"],"permissions":{"pub_allow":["orders.>","events.>"],"sub_allow":["` + InboxPrefix(iss, "writer") + `.>"],` + guardrails + `}}
+{"decision":"success","token_issuer":"` + iss + `","token_sub":"reader","scopes":["nats:subscribe"],"permissions":{"sub_allow":["orders.>","events.>","` + inbox + `"],` + guardrails + `}}
+{"decision":"failure","token_issuer":"` + iss + `","token_sub":"auditor","scopes":["nats:audit"],"reason":"no authorized NATS scopes in token"}
+{"decision":"failure","reason":"token validation failed: expired"}
+{"decision":"shadow_diff","token_sub":"writer"}
+`
+	proposed := &Policy{
+		Scopes: map[string]ScopeMapping{
+			"nats:subscribe": {SubAllow: []string{"orders.>", "_INBOX.>"}},
+			"nats:audit":     {SubAllow: []string{"audit.>"}},
+		},
+		Account:    DefaultAccount,
+		Guardrails: &DefaultGuardrails,
+	}
+
+	report, err := ReplayEvents(strings.NewReader(events), proposed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Events != 5 || report.Replayed != 3 || report.Skipped != 2 {
+		t.Fatalf("unexpected counts: %+v", report)
+	}
+
+	bySubject := make(map[string]*IdentityImpact)
+	for _, i := range report.Identities {
+		bySubject[i.Subject] = i
+	}
+
+	writer := bySubject["writer"]
+	if writer.AllowToDeny != 1 || writer.Gained != nil {
+		t.Errorf("expected writer to flip to deny with nothing gained, got %+v", writer)
+	}
+
+	reader := bySubject["reader"]
+	if reader.AllowToDeny != 0 || reader.Gained != nil {
+		t.Errorf("expected reader to stay allowed with nothing gained, got %+v", reader)
+	}
+	if reader.Lost == nil || !reflect.DeepEqual(reader.Lost.SubAllow, []string{"events.>"}) {
+		t.Errorf("expected reader to lose sub events.>, got %+v", reader.Lost)
+	}
+
+	auditor := bySubject["auditor"]
+	if auditor.DenyToAllow != 1 {
+		t.Errorf("expected auditor to flip to allow, got %+v", auditor)
+	}
+	if auditor.Gained == nil || len(auditor.Gained.SubAllow) != 1 || auditor.Gained.SubAllow[0] != "audit.>" {
+		t.Errorf("expected auditor to gain sub audit.>, got %+v", auditor.Gained)
+	}
+}
+
+func TestReplayEvents_ExcludesNonPolicyOutcomesAndAppliesDownscope(t *testing.T) {
+	iss := "https://issuer.example.com"
+	guardrails := `"pub_deny":["$SYS.>","$JS.API.>","auth.audit.>"],"sub_deny":["$SYS.>","$JS.API.>"]`
+	events := `
+{"decision":"failure","token_issuer":"` + iss + `","token_sub":"mallory","scopes":["nats:subscribe"],"reason":"token revoked","reason_code":"token_revoked"}
+{"decision":"failure","token_issuer":"` + iss + `","token_sub":"eve","scopes":["nats:subscribe"],"reason":"identity disabled by override","override_applied":true}
+{"decision":"success","token_issuer":"` + iss + `","token_sub":"oncall","scopes":["nats:subscribe"],"grants":["g-1"],"permissions":{"pub_allow":["orders.>"],"sub_allow":["orders.>","events.>","` + InboxPrefix(iss, "oncall") + `.>"],` + guardrails + `}}
+{"decision":"success","token_issuer":"` + iss + `","token_sub":"narrow","scopes":["nats:subscribe"],"requested":{"sub":["orders.eu.>"]},"permissions":{"sub_allow":["orders.eu.>","` + InboxPrefix(iss, "narrow") + `.>"],` + guardrails + `}}
+{"decision":"failure","token_issuer":"` + iss + `","token_sub":"greedy","scopes":["nats:subscribe"],"requested":{"roles":["nats:publish"]},"reason":"no authorized NATS scopes in token"}
+`
+	report, err := ReplayEvents(strings.NewReader(events), DefaultPolicy())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Events != 5 || report.Replayed != 2 || report.Excluded != 3 {
+		t.Fatalf("unexpected counts: %+v", report)
+	}
+	for _, impact := range report.Identities {
+		if impact.Changed() {
+			t.Errorf("expected no change for %s under the same policy, got %+v gained=%+v lost=%+v", impact.Subject, impact, impact.Gained, impact.Lost)
+		}
+	}
+}
+
+func TestReplayEvents_UsesRecordedAssurance(t *testing.T) {
+	iss := "https://issuer.example.com"
+	events := `
+{"decision":"success","token_issuer":"` + iss + `","token_sub":"alice","scopes":["prod:deploy"],"assurance":{"acr":"gold","amr":["pwd","mfa"]},"permissions":{"pub_allow":["prod.deploy.>"],"sub_allow":["` + InboxPrefix(iss, "alice") + `.>"]}}
+{"decision":"failure","token_issuer":"` + iss + `","token_sub":"bob","scopes":["prod:deploy"],"reason":"scope prod:deploy requires stronger authentication","reason_code":"assurance_required","assurance":{"acr":"bronze","amr":["pwd"]}}
+`
+	report, err := ReplayEvents(strings.NewReader(events), assurancePolicy(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Replayed != 2 || report.Excluded != 0 {
+		t.Fatalf("expected assurance outcomes to be replayed, got %+v", report)
+	}
+	for _, impact := range report.Identities {
+		if impact.AllowToDeny != 0 || impact.DenyToAllow != 0 {
+			t.Errorf("expected %s to keep its recorded decision, got %+v", impact.Subject, impact)
+		}
+	}
+}
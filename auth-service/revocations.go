@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Admin API subjects for the revocation list. Like the grant admin API they
+// are served on the auth service's own connection.
+const (
+	RevocationAddSubject    = "auth.admin.revocations.add"
+	RevocationRemoveSubject = "auth.admin.revocations.remove"
+	RevocationListSubject   = "auth.admin.revocations.list"
+)
+
+// DefaultRevocationAdminScope is the scope a token needs to add or remove
+// revocations.
+const DefaultRevocationAdminScope = "nats:revocation-admin"
+
+// Revocation kinds: what a revocation's Value is matched against.
+const (
+	RevokeJTI      = "jti"
+	RevokeSubject  = "sub"
+	RevokeClientID = "client_id"
+)
+
+// Revocation denies tokens of one issuer by jti, subject or client_id. Subject
+// and client_id revocations apply to tokens issued before NotBefore, so
+// tokens issued after the credentials were rotated are accepted again; a
+// NotBefore in the far future blocks the identity until the entry is
+// removed. A jti revocation is pointless once its token has expired, so it
+// carries the token's exp in ExpiresAt and is deleted after it.
+type Revocation struct {
+	Issuer    string     `json:"issuer"`
+	Kind      string     `json:"kind"`
+	Value     string     `json:"value"`
+	NotBefore time.Time  `json:"not_before"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Reason    string     `json:"reason"`
+	RevokedBy string     `json:"revoked_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	RemovedBy string     `json:"removed_by,omitempty"` // set on the removed audit event
+}
+
+// RevocationRequest is the payload of a revocation add request. The revoker
+// is not named but authenticated: approver_token must carry the revocation
+// admin scope, and its subject is recorded as RevokedBy.
+type RevocationRequest struct {
+	Issuer        string    `json:"issuer"`
+	Kind          string    `json:"kind"`
+	Value         string    `json:"value"`
+	NotBefore     time.Time `json:"not_before"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Reason        string    `json:"reason"`
+	ApproverToken string    `json:"approver_token"`
+}
+
+// RevocationRemoveRequest is the payload of a revocation remove request.
+// Like additions, removals require an approver token.
+type RevocationRemoveRequest struct {
+	Issuer        string `json:"issuer"`
+	Kind          string `json:"kind"`
+	Value         string `json:"value"`
+	ApproverToken string `json:"approver_token"`
+}
+
+// RevocationKey returns the store key for a revocation. Issuer and value are
+// base64url-encoded so the key is valid as a NATS KV key.
+func RevocationKey(issuer, kind, value string) string {
+	return kind + "." + encodeKeyParts(issuer, value)
+}
+
+// Key returns the revocation's store key.
+func (r *Revocation) Key() string { return RevocationKey(r.Issuer, r.Kind, r.Value) }
+
+// NewRevocation validates a request made by the holder of revoker and builds
+// the revocation, defaulting NotBefore to now.
+func NewRevocation(req RevocationRequest, revoker *OIDCClaims, now time.Time) (*Revocation, error) {
+	switch req.Kind {
+	case RevokeJTI, RevokeSubject, RevokeClientID:
+	default:
+		return nil, fmt.Errorf("kind must be %s, %s or %s", RevokeJTI, RevokeSubject, RevokeClientID)
+	}
+	if req.Issuer == "" || req.Value == "" {
+		return nil, fmt.Errorf("issuer and value are required")
+	}
+	if req.Reason == "" {
+		return nil, fmt.Errorf("reason is required")
+	}
+	if revoker == nil || revoker.Subject == "" {
+		return nil, fmt.Errorf("revoker is required")
+	}
+	r := &Revocation{
+		Issuer:    req.Issuer,
+		Kind:      req.Kind,
+		Value:     req.Value,
+		NotBefore: req.NotBefore,
+		Reason:    req.Reason,
+		RevokedBy: revoker.Subject,
+		CreatedAt: now,
+	}
+	if r.NotBefore.IsZero() {
+		r.NotBefore = now
+	}
+	switch {
+	case req.Kind != RevokeJTI && !req.ExpiresAt.IsZero():
+		return nil, fmt.Errorf("expires_at applies only to %s revocations", RevokeJTI)
+	case req.Kind == RevokeJTI && req.ExpiresAt.IsZero():
+		return nil, fmt.Errorf("expires_at, the token's exp, is required for %s revocations", RevokeJTI)
+	case req.Kind == RevokeJTI && !req.ExpiresAt.After(now):
+		return nil, fmt.Errorf("token already expired at %s", req.ExpiresAt.Format(time.RFC3339))
+	case req.Kind == RevokeJTI:
+		r.ExpiresAt = &req.ExpiresAt
+	}
+	return r, nil
+}
+
+// matches reports whether the revocation denies a token with these claims.
+// A token without iat counts as issued before NotBefore.
+func (r *Revocation) matches(claims *OIDCClaims) bool {
+	if r.Kind == RevokeJTI {
+		return true
+	}
+	return claims.IssuedAt.IsZero() || claims.IssuedAt.Before(r.NotBefore)
+}
+
+// RevocationList mirrors the revocation KV bucket in memory.
+type RevocationList struct {
+	mu      sync.RWMutex
+	entries map[string]*Revocation
+}
+
+// NewRevocationList creates an empty list.
+func NewRevocationList() *RevocationList {
+	return &RevocationList{entries: make(map[string]*Revocation)}
+}
+
+// Check returns the revocation denying a token from issuer with these
+// claims, or nil. A nil list revokes nothing.
+func (l *RevocationList) Check(issuer string, claims *OIDCClaims) *Revocation {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, c := range []struct{ kind, value string }{
+		{RevokeJTI, claims.JWTID}, {RevokeSubject, claims.Subject}, {RevokeClientID, claims.ClientID},
+	} {
+		if c.value == "" {
+			continue
+		}
+		if r, ok := l.entries[RevocationKey(issuer, c.kind, c.value)]; ok && r.matches(claims) {
+			return r
+		}
+	}
+	return nil
+}
+
+// List returns all revocations sorted by creation time.
+func (l *RevocationList) List() []*Revocation {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]*Revocation, 0, len(l.entries))
+	for _, r := range l.entries {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// Sweep removes and returns the jti revocations whose token has expired at
+// now. Tokens are accepted until exp plus their issuer's clock skew, which
+// skew returns.
+func (l *RevocationList) Sweep(now time.Time, skew func(issuer string) time.Duration) []*Revocation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var expired []*Revocation
+	for key, r := range l.entries {
+		if r.ExpiresAt != nil && now.After(r.ExpiresAt.Add(skew(r.Issuer))) {
+			expired = append(expired, r)
+			delete(l.entries, key)
+		}
+	}
+	return expired
+}
+
+func (l *RevocationList) put(key string, r *Revocation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[key] = r
+}
+
+func (l *RevocationList) delete(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// WatchKV mirrors a NATS KV bucket into the list. Keys must be
+// RevocationKey(issuer, kind, value); values are JSON revocations. It returns
+// once the initial contents have been loaded and keeps applying updates in
+// the background until ctx is cancelled.
+func (l *RevocationList) WatchKV(ctx context.Context, kv nats.KeyValue) error {
+	apply := func(entry nats.KeyValueEntry) {
+		switch entry.Operation() {
+		case nats.KeyValueDelete, nats.KeyValuePurge:
+			l.delete(entry.Key())
+		default:
+			var r Revocation
+			if err := json.Unmarshal(entry.Value(), &r); err != nil {
+				log.Printf("Ignoring invalid revocation %s: %v", entry.Key(), err)
+				return
+			}
+			l.put(entry.Key(), &r)
+		}
+	}
+
+	if err := watchKV(ctx, kv, apply); err != nil {
+		return fmt.Errorf("failed to watch revocations bucket %s: %w", kv.Bucket(), err)
+	}
+	return nil
+}
+
+// RevocationResponse is the reply to every revocation admin request.
+type RevocationResponse struct {
+	Revocation  *Revocation   `json:"revocation,omitempty"`
+	Revocations []*Revocation `json:"revocations,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// RevocationAdminConfig configures the revocation admin API.
+type RevocationAdminConfig struct {
+	AdminScope    string        // defaults to DefaultRevocationAdminScope
+	SweepInterval time.Duration // defaults to 10s
+}
+
+// ServeRevocationAdmin subscribes to the revocation admin subjects in the
+// admin queue group, so each request is handled by one replica, and deletes
+// expired jti revocations in the background until ctx is cancelled. Entries
+// are written to kv, which every replica watches, and applied to list
+// immediately so the serving replica enforces them without waiting for the
+// watch. Additions and removals authenticate with a token from verifiers
+// carrying cfg.AdminScope that list does not revoke.
+func ServeRevocationAdmin(ctx context.Context, nc *nats.Conn, kv nats.KeyValue, list *RevocationList, verifiers *VerifierSet, audit *AuditPublisher, cfg RevocationAdminConfig) error {
+	if cfg.AdminScope == "" {
+		cfg.AdminScope = DefaultRevocationAdminScope
+	}
+	if cfg.SweepInterval == 0 {
+		cfg.SweepInterval = 10 * time.Second
+	}
+	respond := func(msg *nats.Msg, resp RevocationResponse) {
+		data, _ := json.Marshal(resp)
+		if err := msg.Respond(data); err != nil {
+			log.Printf("Failed to respond to %s: %v", msg.Subject, err)
+		}
+	}
+
+	handlers := map[string]nats.MsgHandler{
+		RevocationAddSubject: func(msg *nats.Msg) {
+			var req RevocationRequest
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				respond(msg, RevocationResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+				return
+			}
+			reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			revoker, err := approverClaims(reqCtx, verifiers, list, req.ApproverToken, cfg.AdminScope)
+			if err != nil {
+				respond(msg, RevocationResponse{Error: err.Error()})
+				return
+			}
+			r, err := NewRevocation(req, revoker, time.Now().UTC())
+			if err != nil {
+				respond(msg, RevocationResponse{Error: err.Error()})
+				return
+			}
+			data, _ := json.Marshal(r)
+			if _, err := kv.Put(r.Key(), data); err != nil {
+				respond(msg, RevocationResponse{Error: fmt.Sprintf("failed to store revocation: %v", err)})
+				return
+			}
+			list.put(r.Key(), r)
+			log.Printf("Revoked %s=%s of %s issued before %s (by %s, reason=%q)", r.Kind, r.Value, r.Issuer, r.NotBefore, r.RevokedBy, r.Reason)
+			audit.PublishRevocation("added", r)
+			respond(msg, RevocationResponse{Revocation: r})
+		},
+		RevocationRemoveSubject: func(msg *nats.Msg) {
+			var req RevocationRemoveRequest
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				respond(msg, RevocationResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+				return
+			}
+			reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			remover, err := approverClaims(reqCtx, verifiers, list, req.ApproverToken, cfg.AdminScope)
+			if err != nil {
+				respond(msg, RevocationResponse{Error: err.Error()})
+				return
+			}
+			key := RevocationKey(req.Issuer, req.Kind, req.Value)
+			entry, err := kv.Get(key)
+			if err != nil {
+				respond(msg, RevocationResponse{Error: fmt.Sprintf("revocation %s=%s of %s not found", req.Kind, req.Value, req.Issuer)})
+				return
+			}
+			var r Revocation
+			if err := json.Unmarshal(entry.Value(), &r); err != nil {
+				respond(msg, RevocationResponse{Error: fmt.Sprintf("invalid stored revocation %s: %v", key, err)})
+				return
+			}
+			if err := kv.Delete(key); err != nil {
+				respond(msg, RevocationResponse{Error: fmt.Sprintf("failed to remove revocation: %v", err)})
+				return
+			}
+			list.delete(key)
+			r.RemovedBy = remover.Subject
+			log.Printf("Removed revocation of %s=%s of %s (by %s)", r.Kind, r.Value, r.Issuer, r.RemovedBy)
+			audit.PublishRevocation("removed", &r)
+			respond(msg, RevocationResponse{Revocation: &r})
+		},
+		RevocationListSubject: func(msg *nats.Msg) {
+			respond(msg, RevocationResponse{Revocations: list.List()})
+		},
+	}
+	for subject, handler := range handlers {
+		sub, err := nc.QueueSubscribe(subject, adminQueue, handler)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+		}
+		go func() {
+			<-ctx.Done()
+			sub.Unsubscribe()
+		}()
+	}
+
+	skew := func(issuer string) time.Duration {
+		v, err := verifiers.lookup(issuer)
+		if err != nil {
+			return 0
+		}
+		return v.Config().ClockSkew.Duration()
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.SweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, r := range list.Sweep(now, skew) {
+					if !claimExpiry(kv, r.Key()) {
+						continue
+					}
+					log.Printf("Revocation of %s=%s of %s expired with its token", r.Kind, r.Value, r.Issuer)
+					audit.PublishRevocation("expired", r)
+				}
+			}
+		}
+	}()
+	return nil
+}
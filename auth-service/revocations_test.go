@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestRevocationList_Check(t *testing.T) {
+	const issuer = "https://login.example.com"
+	cutoff := time.Now()
+	list := NewRevocationList()
+	for _, r := range []*Revocation{
+		{Issuer: issuer, Kind: RevokeJTI, Value: "t-1"},
+		{Issuer: issuer, Kind: RevokeSubject, Value: "alice", NotBefore: cutoff},
+		{Issuer: issuer, Kind: RevokeClientID, Value: "leaky-app", NotBefore: cutoff},
+	} {
+		list.put(r.Key(), r)
+	}
+
+	tests := []struct {
+		name    string
+		issuer  string
+		claims  OIDCClaims
+		revoked string
+	}{
+		{"jti", issuer, OIDCClaims{Subject: "bob", JWTID: "t-1", IssuedAt: cutoff.Add(time.Hour)}, RevokeJTI},
+		{"sub issued before", issuer, OIDCClaims{Subject: "alice", IssuedAt: cutoff.Add(-time.Minute)}, RevokeSubject},
+		{"sub without iat", issuer, OIDCClaims{Subject: "alice"}, RevokeSubject},
+		{"sub issued after", issuer, OIDCClaims{Subject: "alice", IssuedAt: cutoff.Add(time.Minute)}, ""},
+		{"client_id", issuer, OIDCClaims{Subject: "svc", ClientID: "leaky-app", IssuedAt: cutoff.Add(-time.Minute)}, RevokeClientID},
+		{"other issuer", "https://other.example.com", OIDCClaims{Subject: "alice", JWTID: "t-1"}, ""},
+		{"unrelated", issuer, OIDCClaims{Subject: "bob", JWTID: "t-2"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := list.Check(tt.issuer, &tt.claims)
+			switch {
+			case tt.revoked == "" && r != nil:
+				t.Errorf("unexpected revocation %+v", r)
+			case tt.revoked != "" && (r == nil || r.Kind != tt.revoked):
+				t.Errorf("expected %s revocation, got %+v", tt.revoked, r)
+			}
+		})
+	}
+
+	var none *RevocationList
+	if none.Check(issuer, &OIDCClaims{Subject: "alice"}) != nil {
+		t.Error("expected a nil list to revoke nothing")
+	}
+}
+
+func TestServeRevocationAdmin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nc, js := runJetStream(t)
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "auth-revocations"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iss := newFakeIssuer(t, "https://login.example.com")
+	issuer := iss.url
+	verifiers := NewVerifierSet(iss.verifier())
+	alice := &OIDCClaims{Subject: "alice", IssuedAt: time.Now().Add(-time.Minute)}
+	adminToken := iss.sign(t, "ops", DefaultRevocationAdminScope, time.Hour, nil)
+
+	// Two replicas watching the bucket and serving the admin API.
+	replicas := []*RevocationList{NewRevocationList(), NewRevocationList()}
+	audits, err := nc.SubscribeSync("auth.audit.revocation.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range replicas {
+		if err := l.WatchKV(ctx, kv); err != nil {
+			t.Fatal(err)
+		}
+		// An admin whose own tokens are revoked cannot manage the list.
+		l.put(RevocationKey(issuer, RevokeSubject, "mallory"), &Revocation{
+			Issuer: issuer, Kind: RevokeSubject, Value: "mallory", NotBefore: time.Now().Add(time.Hour),
+		})
+		cfg := RevocationAdminConfig{SweepInterval: 20 * time.Millisecond}
+		if err := ServeRevocationAdmin(ctx, nc, kv, l, verifiers, NewAuditPublisher(nc), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revoked := func(l *RevocationList) bool { return l.Check(issuer, alice) != nil }
+	request := func(subject string, req any) RevocationResponse {
+		t.Helper()
+		msg, err := nc.Request(subject, mustMarshal(t, req), 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp RevocationResponse
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	revokeAlice := RevocationRequest{Issuer: issuer, Kind: RevokeSubject, Value: "alice", Reason: "laptop stolen", ApproverToken: adminToken}
+	for name, token := range map[string]string{
+		"no token":      "",
+		"invalid token": "not-a-jwt",
+		"missing scope": iss.sign(t, "ops", "nats:subscribe", time.Hour, nil),
+		"revoked":       iss.sign(t, "mallory", DefaultRevocationAdminScope, time.Hour, nil),
+	} {
+		req := revokeAlice
+		req.ApproverToken = token
+		if resp := request(RevocationAddSubject, req); resp.Error == "" {
+			t.Errorf("%s: expected the addition to be rejected", name)
+		}
+	}
+	for name, mutate := range map[string]func(*RevocationRequest){
+		"invalid kind":        func(r *RevocationRequest) { r.Kind = "email" },
+		"no reason":           func(r *RevocationRequest) { r.Reason = "" },
+		"expiring sub":        func(r *RevocationRequest) { r.ExpiresAt = time.Now().Add(time.Hour) },
+		"jti without exp":     func(r *RevocationRequest) { r.Kind = RevokeJTI },
+		"jti already expired": func(r *RevocationRequest) { r.Kind, r.ExpiresAt = RevokeJTI, time.Now().Add(-time.Minute) },
+	} {
+		req := revokeAlice
+		mutate(&req)
+		if resp := request(RevocationAddSubject, req); resp.Error == "" {
+			t.Errorf("%s: expected the addition to be rejected", name)
+		}
+	}
+
+	// The revoker is taken from the token, not from the request.
+	resp := request(RevocationAddSubject, struct {
+		RevocationRequest
+		RevokedBy string `json:"revoked_by"`
+	}{revokeAlice, "someone-else"})
+	if resp.Error != "" || resp.Revocation.NotBefore.IsZero() || resp.Revocation.RevokedBy != "ops" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if !revoked(replicas[0]) && !revoked(replicas[1]) {
+		t.Error("expected the serving replica to enforce the revocation immediately")
+	}
+	waitFor(t, "revocation to reach both replicas", func() bool { return revoked(replicas[0]) && revoked(replicas[1]) })
+	if resp := request(RevocationListSubject, struct{}{}); len(resp.Revocations) != 2 {
+		t.Errorf("expected 2 revocations, got %+v", resp)
+	}
+
+	removeAlice := RevocationRemoveRequest{Issuer: issuer, Kind: RevokeSubject, Value: "alice"}
+	if resp := request(RevocationRemoveSubject, removeAlice); resp.Error == "" {
+		t.Error("expected a removal without approver token to be rejected")
+	}
+	removeAlice.ApproverToken = adminToken
+	if resp := request(RevocationRemoveSubject, removeAlice); resp.Error != "" || resp.Revocation.RemovedBy != "ops" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	waitFor(t, "removal to reach both replicas", func() bool { return !revoked(replicas[0]) && !revoked(replicas[1]) })
+	if resp := request(RevocationRemoveSubject, removeAlice); resp.Error == "" {
+		t.Error("expected removing a missing revocation to fail")
+	}
+
+	// A jti revocation is deleted once its token has expired.
+	token := &OIDCClaims{Subject: "bob", JWTID: "t-1"}
+	resp = request(RevocationAddSubject, RevocationRequest{
+		Issuer: issuer, Kind: RevokeJTI, Value: "t-1", ExpiresAt: time.Now().Add(100 * time.Millisecond),
+		Reason: "token leaked", ApproverToken: adminToken,
+	})
+	if resp.Error != "" || resp.Revocation.ExpiresAt == nil {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	waitFor(t, "jti revocation to expire", func() bool {
+		_, err := kv.Get(RevocationKey(issuer, RevokeJTI, "t-1"))
+		return errors.Is(err, nats.ErrKeyNotFound) && replicas[0].Check(issuer, token) == nil && replicas[1].Check(issuer, token) == nil
+	})
+
+	for _, subject := range []string{
+		"auth.audit.revocation.added", "auth.audit.revocation.removed",
+		"auth.audit.revocation.added", "auth.audit.revocation.expired",
+	} {
+		msg, err := audits.NextMsg(time.Second)
+		if err != nil || msg.Subject != subject {
+			t.Fatalf("expected %s audit event, got %v %v", subject, msg, err)
+		}
+	}
+	// A corrupt entry is reported rather than removed and audited as empty.
+	if _, err := kv.Put(RevocationKey(issuer, RevokeSubject, "eve"), []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	removeEve := RevocationRemoveRequest{Issuer: issuer, Kind: RevokeSubject, Value: "eve", ApproverToken: adminToken}
+	if resp := request(RevocationRemoveSubject, removeEve); resp.Error == "" || resp.Revocation != nil {
+		t.Errorf("expected removing a corrupt revocation to fail, got %+v", resp)
+	}
+
+	if msg, err := audits.NextMsg(200 * time.Millisecond); err == nil {
+		t.Errorf("expected one audit event per request, got extra %s", msg.Subject)
+	}
+}
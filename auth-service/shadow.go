@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+)
+
+// DiffDecisions lists the fields in which two decisions differ: "decision",
+// "account", "pub_allow", "sub_allow", "pub_deny", "sub_deny" and "limits".
+func DiffDecisions(active, candidate *Decision) []string {
+	var diffs []string
+	if active.Allowed != candidate.Allowed {
+		diffs = append(diffs, "decision")
+	}
+	if active.Account != candidate.Account {
+		diffs = append(diffs, "account")
+	}
+	a, c := active.Permissions, candidate.Permissions
+	if !sameSubjects(a.PubAllow, c.PubAllow) {
+		diffs = append(diffs, "pub_allow")
+	}
+	if !sameSubjects(a.SubAllow, c.SubAllow) {
+		diffs = append(diffs, "sub_allow")
+	}
+	if !sameSubjects(a.PubDeny, c.PubDeny) {
+		diffs = append(diffs, "pub_deny")
+	}
+	if !sameSubjects(a.SubDeny, c.SubDeny) {
+		diffs = append(diffs, "sub_deny")
+	}
+	if !reflect.DeepEqual(active.Limits, candidate.Limits) {
+		diffs = append(diffs, "limits")
+	}
+	return diffs
+}
+
+// sameSubjects compares two subject lists ignoring order.
+func sameSubjects(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string(nil), a...)
+	y := append([]string(nil), b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffDecisions_Identical(t *testing.T) {
+	claims := &OIDCClaims{Issuer: "https://issuer.example.com", Subject: "svc", Scopes: []string{"nats:publish"}}
+	active := DefaultPolicy().Evaluate(claims, nil, nil)
+	candidate := DefaultPolicy().Evaluate(claims, nil, nil)
+	if diffs := DiffDecisions(active, candidate); len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v", diffs)
+	}
+}
+
+func TestDiffDecisions_Divergent(t *testing.T) {
+	claims := &OIDCClaims{Issuer: "https://issuer.example.com", Subject: "svc", Scopes: []string{"nats:publish"}}
+	candidate := &Policy{
+		Scopes: map[string]ScopeMapping{
+			"nats:publish": {PubAllow: []string{"events.>", "orders.>"}, SubAllow: []string{"_INBOX.>"}},
+		},
+		Account:    "TENANT",
+		Limits:     &UserLimits{Subs: 10},
+		Guardrails: &DefaultGuardrails,
+	}
+
+	diffs := DiffDecisions(DefaultPolicy().Evaluate(claims, nil, nil), candidate.Evaluate(claims, nil, nil))
+	expected := []string{"account", "limits"}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected %v (pub_allow order ignored), got %v", expected, diffs)
+	}
+}
+
+func TestDiffDecisions_AllowFlip(t *testing.T) {
+	claims := &OIDCClaims{Subject: "svc", Scopes: []string{"nats:subscribe"}}
+	candidate := &Policy{
+		Scopes:     map[string]ScopeMapping{"nats:admin": {PubAllow: []string{">"}}},
+		Account:    DefaultAccount,
+		Guardrails: &DefaultGuardrails,
+	}
+
+	diffs := DiffDecisions(DefaultPolicy().Evaluate(claims, nil, nil), candidate.Evaluate(claims, nil, nil))
+	expected := []string{"decision", "sub_allow"}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected %v, got %v", expected, diffs)
+	}
+}
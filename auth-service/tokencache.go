@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// TokenCache remembers successful token validations so reconnecting clients
+// skip signature checks and key fetches. Entries are keyed by the SHA-256 of
+// the raw token, so tokens are not held in memory, and live until the
+// token's exp, the issuer's max token age or the cache's TTL, whichever
+// comes first; introspection results use the shorter introspection TTL. Concurrent validations of the same token are collapsed into
+// one; failures are shared with waiting callers but never cached.
+type TokenCache struct {
+	ttl              time.Duration
+	introspectionTTL time.Duration
+	maxEntries       int
+	metrics          *Metrics
+
+	mu         sync.Mutex
+	entries    map[[sha256.Size]byte]*cachedToken
+	inflight   map[[sha256.Size]byte]*tokenCall
+	generation uint64 // incremented by Purge
+}
+
+type cachedToken struct {
+	claims  OIDCClaims
+	issuer  string
+	expires time.Time
+}
+
+// tokenCall is a validation in progress; done is closed once its result is set.
+type tokenCall struct {
+	done   chan struct{}
+	claims *OIDCClaims
+	issuer string
+	err    error
+}
+
+// NewTokenCache creates a cache keeping results for at most ttl, and results
+// of introspection issuers for at most introspectionTTL; 0 never caches
+// them. Hits, misses and collapsed validations are counted in metrics.
+func NewTokenCache(ttl, introspectionTTL time.Duration, metrics *Metrics) *TokenCache {
+	return &TokenCache{
+		ttl:              ttl,
+		introspectionTTL: introspectionTTL,
+		maxEntries:       10000,
+		metrics:          metrics,
+		entries:          make(map[[sha256.Size]byte]*cachedToken),
+		inflight:         make(map[[sha256.Size]byte]*tokenCall),
+	}
+}
+
+// validate returns the cached result for rawToken, waits for a validation of
+// the same token already in progress, or runs validate and caches its
+// result. The returned claims are a copy owned by the caller.
+func (c *TokenCache) validate(ctx context.Context, rawToken string, validate func() (*OIDCClaims, string, time.Time, error)) (*OIDCClaims, string, error) {
+	key := sha256.Sum256([]byte(rawToken))
+	now := time.Now()
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		if now.Before(e.expires) {
+			c.mu.Unlock()
+			c.metrics.Inc("auth_token_cache_hits_total")
+			claims := e.claims
+			return &claims, e.issuer, nil
+		}
+		delete(c.entries, key)
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		c.metrics.Inc("auth_token_cache_collapsed_total")
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+		if call.err != nil {
+			return nil, call.issuer, call.err
+		}
+		claims := *call.claims
+		return &claims, call.issuer, nil
+	}
+	call := &tokenCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	generation := c.generation
+	c.mu.Unlock()
+	c.metrics.Inc("auth_token_cache_misses_total")
+
+	claims, issuer, validUntil, err := validate()
+	call.claims, call.issuer, call.err = claims, issuer, err
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if err == nil {
+		expires := now.Add(c.ttl)
+		if !validUntil.IsZero() && validUntil.Before(expires) {
+			expires = validUntil
+		}
+		// A result computed across a purge may come from a removed issuer.
+		done := time.Now()
+		if generation == c.generation && expires.After(done) && c.makeRoom(done) {
+			c.entries[key] = &cachedToken{claims: *claims, issuer: issuer, expires: expires}
+		}
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	if err != nil {
+		return nil, issuer, err
+	}
+	copied := *claims
+	return &copied, issuer, nil
+}
+
+// makeRoom drops expired entries when the cache is full and reports whether
+// a new entry fits. The caller holds mu.
+func (c *TokenCache) makeRoom(now time.Time) bool {
+	if len(c.entries) < c.maxEntries {
+		return true
+	}
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	return len(c.entries) < c.maxEntries
+}
+
+// Purge drops every cached result, e.g. when the trusted issuers change.
+func (c *TokenCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	c.generation++
+}
+
+// Len returns the number of cached results, including expired ones not yet
+// dropped.
+func (c *TokenCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingVerifier counts verifications and can hold them until released.
+type countingVerifier struct {
+	TokenVerifier
+	calls   atomic.Int32
+	release chan struct{} // nil to verify immediately
+}
+
+func (v *countingVerifier) Verify(ctx context.Context, rawToken string) (*OIDCClaims, error) {
+	v.calls.Add(1)
+	if v.release != nil {
+		<-v.release
+	}
+	return v.TokenVerifier.Verify(ctx, rawToken)
+}
+
+func TestTokenCache_HitsAndMisses(t *testing.T) {
+	iss := newFakeIssuer(t, "https://login.example.com")
+	v := &countingVerifier{TokenVerifier: iss.verifier()}
+	metrics := NewMetrics()
+	verifiers := NewVerifierSet(v)
+	verifiers.SetCache(NewTokenCache(time.Hour, time.Hour, metrics))
+	token := iss.sign(t, "svc", "nats:admin", time.Hour, nil)
+
+	for i := 0; i < 3; i++ {
+		claims, issuer, err := ValidateToken(context.Background(), token, verifiers)
+		if err != nil || claims.Subject != "svc" || issuer != iss.url {
+			t.Fatalf("unexpected result: %+v %q %v", claims, issuer, err)
+		}
+		claims.Subject = "mutated"
+	}
+	if v.calls.Load() != 1 {
+		t.Errorf("expected 1 verification, got %d", v.calls.Load())
+	}
+	if hits, misses := metrics.Value("auth_token_cache_hits_total"), metrics.Value("auth_token_cache_misses_total"); hits != 2 || misses != 1 {
+		t.Errorf("expected 2 hits and 1 miss, got %d and %d", hits, misses)
+	}
+
+	// Failures are not cached.
+	expired := iss.sign(t, "svc", "nats:admin", -time.Minute, nil)
+	for i := 0; i < 2; i++ {
+		if _, _, err := ValidateToken(context.Background(), expired, verifiers); !errors.Is(err, ErrTokenExpired) {
+			t.Fatalf("expected expired token, got %v", err)
+		}
+	}
+	if v.calls.Load() != 3 {
+		t.Errorf("expected failed validations to be repeated, got %d calls", v.calls.Load())
+	}
+
+	// Removing the issuer drops its cached results.
+	verifiers.Sync(context.Background(), nil)
+	if _, _, err := ValidateToken(context.Background(), token, verifiers); !errors.Is(err, ErrUnknownIssuer) {
+		t.Errorf("expected removed issuer to be unknown, got %v", err)
+	}
+}
+
+func TestTokenCache_IntrospectionTTL(t *testing.T) {
+	srv := newIntrospectionServer(t, map[string]map[string]any{
+		"opaque-svc": {"active": true, "scope": "nats:admin", "client_id": "svc", "exp": time.Now().Add(time.Hour).Unix()},
+	})
+	t.Setenv("TEST_INTROSPECTION_SECRET", "s3cret%")
+	iv, err := NewIntrospectionVerifier(context.Background(), IssuerConfig{
+		URL:              "https://idp.example.com",
+		Type:             IssuerTypeIntrospection,
+		IntrospectionURL: srv.URL,
+		ClientID:         "nats-auth",
+		ClientSecretEnv:  "TEST_INTROSPECTION_SECRET",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		ttl   time.Duration
+		calls int32
+	}{
+		{0, 3},         // the default: every callout asks the IdP
+		{time.Hour, 1}, // capped by the cache's TTL instead
+	} {
+		v := &countingVerifier{TokenVerifier: iv}
+		verifiers := NewVerifierSet(v)
+		verifiers.SetCache(NewTokenCache(time.Hour, tc.ttl, nil))
+		for i := 0; i < 3; i++ {
+			if _, _, err := ValidateToken(context.Background(), "opaque-svc", verifiers); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if v.calls.Load() != tc.calls {
+			t.Errorf("introspection TTL %s: expected %d introspections, got %d", tc.ttl, tc.calls, v.calls.Load())
+		}
+	}
+}
+
+func TestTokenCache_Expiry(t *testing.T) {
+	cache := NewTokenCache(time.Hour, time.Hour, nil)
+	claims := &OIDCClaims{Subject: "svc"}
+	var calls int
+	validate := func(validUntil time.Time) func() (*OIDCClaims, string, time.Time, error) {
+		return func() (*OIDCClaims, string, time.Time, error) {
+			calls++
+			return claims, "https://login.example.com", validUntil, nil
+		}
+	}
+
+	// A result is kept no longer than the token is valid...
+	cache.validate(context.Background(), "a", validate(time.Now().Add(20*time.Millisecond)))
+	cache.validate(context.Background(), "a", validate(time.Now().Add(time.Hour)))
+	time.Sleep(30 * time.Millisecond)
+	cache.validate(context.Background(), "a", validate(time.Now().Add(time.Hour)))
+	if calls != 2 {
+		t.Errorf("expected revalidation after the token expired, got %d calls", calls)
+	}
+
+	// ...nor longer than the cache's TTL.
+	cache.ttl = 20 * time.Millisecond
+	calls = 0
+	cache.validate(context.Background(), "b", validate(time.Now().Add(time.Hour)))
+	time.Sleep(30 * time.Millisecond)
+	cache.validate(context.Background(), "b", validate(time.Now().Add(time.Hour)))
+	if calls != 2 {
+		t.Errorf("expected revalidation after the TTL, got %d calls", calls)
+	}
+}
+
+func TestTokenCache_CollapsesConcurrentValidations(t *testing.T) {
+	iss := newFakeIssuer(t, "https://login.example.com")
+	v := &countingVerifier{TokenVerifier: iss.verifier(), release: make(chan struct{})}
+	metrics := NewMetrics()
+	verifiers := NewVerifierSet(v)
+	verifiers.SetCache(NewTokenCache(time.Hour, time.Hour, metrics))
+	token := iss.sign(t, "svc", "nats:admin", time.Hour, nil)
+
+	const clients = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := ValidateToken(context.Background(), token, verifiers)
+			errs <- err
+		}()
+	}
+	waitFor(t, "collapsed validations", func() bool {
+		return metrics.Value("auth_token_cache_collapsed_total") == clients-1
+	})
+	close(v.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if v.calls.Load() != 1 {
+		t.Errorf("expected 1 verification for %d concurrent clients, got %d", clients, v.calls.Load())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ReplayStore records the jti of every token accepted from an issuer with
+// replay protection, so a token can be used only once.
+type ReplayStore interface {
+	// Use records jti for issuer until expires. It reports false when the
+	// jti is already recorded and has not yet expired.
+	Use(ctx context.Context, issuer, jti string, expires time.Time) (bool, error)
+}
+
+// replayKey derives the store key for a token. Hashing keeps keys valid as
+// NATS KV keys whatever the issuer and jti contain.
+func replayKey(issuer, jti string) string {
+	sum := sha256.Sum256([]byte(issuer + "\x00" + jti))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryReplayStore keeps used jti values in memory. Records are local to
+// one service instance.
+type MemoryReplayStore struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryReplayStore creates an empty store.
+func NewMemoryReplayStore() *MemoryReplayStore {
+	return &MemoryReplayStore{seen: make(map[string]time.Time)}
+}
+
+func (s *MemoryReplayStore) Use(_ context.Context, issuer, jti string, expires time.Time) (bool, error) {
+	key := replayKey(issuer, jti)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, exp := range s.seen {
+			if !now.Before(exp) {
+				delete(s.seen, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	if exp, ok := s.seen[key]; ok && now.Before(exp) {
+		return false, nil
+	}
+	s.seen[key] = expires
+	return true, nil
+}
+
+// KVReplayStore keeps used jti values in a NATS KV bucket shared by all
+// replicas. Each record holds the token's expiry; the bucket's TTL must be
+// at least the longest token lifetime, and a record that outlives its token
+// is reclaimed on the next use of the key.
+type KVReplayStore struct {
+	kv nats.KeyValue
+}
+
+// NewKVReplayStore creates a store backed by kv.
+func NewKVReplayStore(kv nats.KeyValue) *KVReplayStore {
+	return &KVReplayStore{kv: kv}
+}
+
+func (s *KVReplayStore) Use(_ context.Context, issuer, jti string, expires time.Time) (bool, error) {
+	key := replayKey(issuer, jti)
+	value := []byte(expires.UTC().Format(time.RFC3339Nano))
+
+	_, err := s.kv.Create(key, value)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, nats.ErrKeyExists) {
+		return false, err
+	}
+
+	entry, err := s.kv.Get(key)
+	if err != nil {
+		return false, err
+	}
+	recorded, err := time.Parse(time.RFC3339Nano, string(entry.Value()))
+	if err == nil && time.Now().Before(recorded) {
+		return false, nil
+	}
+	// The record outlived its token; take it over unless another replica
+	// got there first.
+	if _, err := s.kv.Update(key, value, entry.Revision()); err != nil {
+		if errors.Is(err, nats.ErrKeyExists) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// checkReplay records the token's jti when its issuer has replay protection
+// enabled, failing for a token seen before.
+func (s *VerifierSet) checkReplay(ctx context.Context, claims *OIDCClaims, issuer string) error {
+	v, err := s.lookup(issuer)
+	if err != nil {
+		return err
+	}
+	if !v.Config().ReplayProtection {
+		return nil
+	}
+	s.mu.RLock()
+	store := s.replay
+	s.mu.RUnlock()
+	if store == nil {
+		return fmt.Errorf("%w: no replay store configured", ErrReplayCheck)
+	}
+	if claims.JWTID == "" {
+		return fmt.Errorf("%w: jti", ErrMissingClaim)
+	}
+	// Tokens are accepted until exp plus the clock skew.
+	expires := claims.Expiry.Add(v.Config().ClockSkew.Duration())
+	first, err := store.Use(ctx, issuer, claims.JWTID, expires)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReplayCheck, err)
+	}
+	if !first {
+		return fmt.Errorf("%w: jti %s", ErrTokenReplayed, claims.JWTID)
+	}
+	return nil
+}
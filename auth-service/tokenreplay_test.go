@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestValidateToken_ReplayProtection(t *testing.T) {
+	iss := newFakeIssuer(t, "https://login.example.com")
+	verifiers := NewVerifierSet(iss.configured(IssuerConfig{URL: iss.url, ReplayProtection: true}))
+	verifiers.SetReplayStore(NewMemoryReplayStore())
+	// Cached results must not bypass the replay check.
+	verifiers.SetCache(NewTokenCache(time.Hour, time.Hour, nil))
+
+	token := iss.sign(t, "bootstrap", "nats:publish", time.Hour, map[string]any{"jti": "once-1"})
+	if _, _, err := ValidateToken(context.Background(), token, verifiers); err != nil {
+		t.Fatalf("unexpected error on first use: %v", err)
+	}
+	_, issuer, err := ValidateToken(context.Background(), token, verifiers)
+	var tokenErr *TokenError
+	if !errors.As(err, &tokenErr) || tokenErr.Code() != "token_replayed" || issuer != iss.url {
+		t.Fatalf("expected token_replayed from %s, got %q %v", iss.url, issuer, err)
+	}
+
+	// Concurrent uses of a fresh token: exactly one wins.
+	token = iss.sign(t, "bootstrap", "nats:publish", time.Hour, map[string]any{"jti": "once-2"})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := ValidateToken(context.Background(), token, verifiers); err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Errorf("expected exactly one concurrent use to be accepted, got %d", accepted)
+	}
+
+	if _, _, err := ValidateToken(context.Background(), iss.sign(t, "bootstrap", "nats:publish", time.Hour, nil), verifiers); !errors.Is(err, ErrMissingClaim) {
+		t.Errorf("expected a token without jti to be rejected, got %v", err)
+	}
+}
+
+func TestMemoryReplayStore_Expiry(t *testing.T) {
+	store := NewMemoryReplayStore()
+	ctx := context.Background()
+	if first, _ := store.Use(ctx, "https://a", "t-1", time.Now().Add(-time.Second)); !first {
+		t.Fatal("expected first use")
+	}
+	// An expired record no longer blocks the jti; the token itself is
+	// rejected as expired by then.
+	if first, _ := store.Use(ctx, "https://a", "t-1", time.Now().Add(time.Hour)); !first {
+		t.Error("expected expired record to be reclaimed")
+	}
+	if first, _ := store.Use(ctx, "https://a", "t-1", time.Now().Add(time.Hour)); first {
+		t.Error("expected replay to be detected")
+	}
+	if first, _ := store.Use(ctx, "https://b", "t-1", time.Now().Add(time.Hour)); !first {
+		t.Error("expected jti to be scoped to its issuer")
+	}
+}
+
+// runJetStream starts an embedded JetStream-enabled server and returns a
+// connection to it.
+func runJetStream(t *testing.T) (*nats.Conn, nats.JetStreamContext) {
+	t.Helper()
+	srv, err := server.NewServer(&server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server not ready")
+	}
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nc, js
+}
+
+func TestKVReplayStore(t *testing.T) {
+	_, js := runJetStream(t)
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "auth-replay", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two replicas sharing the bucket.
+	a, b := NewKVReplayStore(kv), NewKVReplayStore(kv)
+	ctx := context.Background()
+	use := func(store ReplayStore, jti string, expires time.Time) bool {
+		t.Helper()
+		first, err := store.Use(ctx, "https://login.example.com", jti, expires)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return first
+	}
+
+	if !use(a, "t-1", time.Now().Add(time.Hour)) {
+		t.Fatal("expected first use")
+	}
+	if use(b, "t-1", time.Now().Add(time.Hour)) {
+		t.Error("expected replay on another replica to be detected")
+	}
+	if !use(a, "t-2", time.Now().Add(-time.Second)) {
+		t.Fatal("expected first use")
+	}
+	if !use(b, "t-2", time.Now().Add(time.Hour)) {
+		t.Error("expected expired record to be reclaimed")
+	}
+	if use(a, "t-2", time.Now().Add(time.Hour)) {
+		t.Error("expected replay after reclaim to be detected")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// inboxPrefix computes the private reply-inbox prefix the auth service grants
+// for this token. It must stay in sync with InboxPrefix in auth-service/inbox.go.
+func inboxPrefix(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("decode token payload: %w", err)
+	}
+	var claims struct {
+		Issuer   string `json:"iss"`
+		Subject  string `json:"sub"`
+		ClientID string `json:"client_id"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("parse token payload: %w", err)
+	}
+	// PingOne client_credentials tokens use client_id instead of sub
+	if claims.Subject == "" {
+		claims.Subject = claims.ClientID
+	}
+	sum := sha256.Sum256([]byte(claims.Issuer + "\x00" + claims.Subject))
+	return "_INBOX." + hex.EncodeToString(sum[:16]), nil
+}
@@ -91,6 +91,12 @@ func connectNATS(natsURL, token string, tlsCA string) (*nats.Conn, error) {
 	}
 	if token != "" {
 		opts = append(opts, nats.Token(token))
+		// Replies are only delivered to this identity's private inbox
+		if prefix, err := inboxPrefix(token); err == nil {
+			opts = append(opts, nats.CustomInboxPrefix(prefix))
+		} else {
+			info(fmt.Sprintf("cannot derive private reply inbox (%v); using _INBOX.>, so request/reply will be denied", err))
+		}
 	}
 	if tlsCA != "" {
 		opts = append(opts, nats.RootCAs(tlsCA))